@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	pkgerrors "github.com/pkg/errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// amqpPublisher is the part of *amqp.Channel used by AMQPPropagator.
+type amqpPublisher interface {
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// amqpSession is a confirm-mode channel to the broker along with the channels
+// it notifies.
+type amqpSession struct {
+	publisher amqpPublisher
+	confirms  <-chan amqp.Confirmation
+	returns   <-chan amqp.Return
+
+	// closed is closed along with the AMQP channel, including when the
+	// connection is lost.
+	closed <-chan *amqp.Error
+
+	// conn is closed when the session is replaced. It may be nil.
+	conn io.Closer
+}
+
+// dialAMQP connects to the broker at uri and opens a confirm-mode channel.
+func dialAMQP(uri string) (*amqpSession, error) {
+	conn, err := amqp.Dial(uri)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to the AMQP broker at %s: %w", MaskDBURI(uri), err)
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = ch.Confirm(false); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to put the AMQP channel in confirm mode: %w", err)
+	}
+
+	return &amqpSession{
+		publisher: ch,
+		confirms:  ch.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		returns:   ch.NotifyReturn(make(chan amqp.Return, 1)),
+		closed:    ch.NotifyClose(make(chan *amqp.Error, 1)),
+		conn:      conn,
+	}, nil
+}
+
+// AMQPPropagator publishes job status updates to an AMQP exchange instead of
+// sending them to the apps service over HTTP, when --transport is amqp.
+// Messages are persistent and mandatory, and an update is only marked as
+// propagated once the broker confirms that it was routed to a queue. If the
+// connection to the broker is lost, it reconnects before publishing the next
+// update.
+type AMQPPropagator struct {
+	db         *sql.DB
+	exchange   string
+	routingKey string
+	dial       func() (*amqpSession, error)
+
+	mu      sync.Mutex
+	session *amqpSession
+	tag     uint64
+}
+
+// NewAMQPPropagator connects to the broker at uri and returns an
+// *AMQPPropagator that publishes to the exchange with the routing key.
+func NewAMQPPropagator(d *sql.DB, uri, exchange, routingKey string) (*AMQPPropagator, error) {
+	a := newAMQPPropagator(d, exchange, routingKey, func() (*amqpSession, error) {
+		return dialAMQP(uri)
+	})
+	if err := a.connect(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func newAMQPPropagator(d *sql.DB, exchange, routingKey string, dial func() (*amqpSession, error)) *AMQPPropagator {
+	return &AMQPPropagator{
+		db:         d,
+		exchange:   exchange,
+		routingKey: routingKey,
+		dial:       dial,
+	}
+}
+
+// connect replaces the session if the previous one was closed or there isn't
+// one yet. The caller must hold a.mu unless a isn't shared yet.
+func (a *AMQPPropagator) connect() error {
+	if a.session != nil {
+		select {
+		case <-a.session.closed:
+			log.Warn("The AMQP channel was closed; reconnecting to the broker")
+			if a.session.conn != nil {
+				a.session.conn.Close()
+			}
+			a.session = nil
+		default:
+			return nil
+		}
+	}
+
+	session, err := a.dial()
+	if err != nil {
+		return err
+	}
+	// Delivery tags start over on each channel.
+	a.session, a.tag = session, 0
+	return nil
+}
+
+// Close closes the connection to the broker.
+func (a *AMQPPropagator) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.session == nil || a.session.conn == nil {
+		return nil
+	}
+	return a.session.conn.Close()
+}
+
+// Propagate publishes the job's status updates in the order they were sent and
+// marks each one as propagated once the broker confirms it.
+func (a *AMQPPropagator) Propagate(ctx context.Context, uuid string) error {
+	return propagateInOrder(ctx, a.db, uuid, a.publish)
+}
+
+// publish publishes a single update as JSON and waits for the broker to
+// confirm it. Updates are published one at a time so that each confirmation
+// can be matched with its message.
+func (a *AMQPPropagator) publish(ctx context.Context, jsu JobStatusUpdate) error {
+	body, err := json.Marshal(jsu)
+	if err != nil {
+		return pkgerrors.WithStack(err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err = a.connect(); err != nil {
+		return pkgerrors.WithStack(err)
+	}
+
+	err = a.session.publisher.PublishWithContext(ctx, a.exchange, a.routingKey, true, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    jsu.ID,
+		Body:         body,
+	})
+	if err != nil {
+		return pkgerrors.WithStack(err)
+	}
+	a.tag++
+
+	for {
+		select {
+		case <-ctx.Done():
+			return pkgerrors.WithStack(ctx.Err())
+		case confirm, ok := <-a.session.confirms:
+			if !ok {
+				return pkgerrors.WithStack(errors.New("the AMQP channel was closed"))
+			}
+			// Skip the confirmations of messages whose callers gave up waiting.
+			if confirm.DeliveryTag < a.tag {
+				continue
+			}
+			if !confirm.Ack {
+				return pkgerrors.WithStack(fmt.Errorf("the AMQP broker rejected status update %s for job %s", jsu.ID, jsu.UUID))
+			}
+			return a.returned(jsu)
+		}
+	}
+}
+
+// returned returns an error if the broker returned the update because it
+// couldn't be routed to a queue. The broker sends the return before the
+// confirmation, so it's already waiting if there is one.
+func (a *AMQPPropagator) returned(jsu JobStatusUpdate) error {
+	for {
+		select {
+		case ret := <-a.session.returns:
+			if ret.MessageId != jsu.ID {
+				continue
+			}
+			return pkgerrors.WithStack(fmt.Errorf("status update %s for job %s couldn't be routed: %s", jsu.ID, jsu.UUID, ret.ReplyText))
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeBroker confirms each message it's given, returning the ones whose IDs are
+// in unroutable first.
+type fakeBroker struct {
+	confirms   chan amqp.Confirmation
+	returns    chan amqp.Return
+	closed     chan *amqp.Error
+	published  []amqp.Publishing
+	nack       bool
+	unroutable map[string]bool
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		confirms:   make(chan amqp.Confirmation, 1),
+		returns:    make(chan amqp.Return, 1),
+		closed:     make(chan *amqp.Error, 1),
+		unroutable: map[string]bool{},
+	}
+}
+
+// dial returns a session on the broker.
+func (b *fakeBroker) dial() (*amqpSession, error) {
+	return &amqpSession{publisher: b, confirms: b.confirms, returns: b.returns, closed: b.closed}, nil
+}
+
+func (b *fakeBroker) PublishWithContext(_ context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	b.published = append(b.published, msg)
+	if b.unroutable[msg.MessageId] {
+		b.returns <- amqp.Return{MessageId: msg.MessageId, ReplyText: "NO_ROUTE"}
+	}
+	b.confirms <- amqp.Confirmation{DeliveryTag: uint64(len(b.published)), Ack: !b.nack}
+	return nil
+}
+
+func TestAMQPPropagator(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	broker := newFakeBroker()
+	a := newAMQPPropagator(db, "de", "jobs.status-updates", broker.dial)
+
+	expectUpdates(mock, "external-id", "update-1", "update-2")
+	expectMarked(mock, "update-1")
+	expectMarked(mock, "update-2")
+
+	if err = a.Propagate(context.Background(), "external-id"); err != nil {
+		t.Fatalf("error from Propagate(): %s", err)
+	}
+
+	if len(broker.published) != 2 {
+		t.Fatalf("%d messages were published instead of 2", len(broker.published))
+	}
+	msg := broker.published[0]
+	if msg.DeliveryMode != amqp.Persistent {
+		t.Error("the message wasn't persistent")
+	}
+	var jsu JobStatusUpdate
+	if err = json.Unmarshal(msg.Body, &jsu); err != nil {
+		t.Fatalf("error parsing the message: %s", err)
+	}
+	if jsu.ID != "update-1" || jsu.UUID != "external-id" || jsu.Status != "Running" {
+		t.Errorf("unexpected message: %+v", jsu)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("the updates weren't marked as propagated: %s", err)
+	}
+}
+
+func TestAMQPPropagatorFailures(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	broker := newFakeBroker()
+	broker.unroutable["update-1"] = true
+	a := newAMQPPropagator(db, "de", "jobs.status-updates", broker.dial)
+
+	expectUpdates(mock, "external-id", "update-1")
+	if err = a.Propagate(context.Background(), "external-id"); err == nil || !strings.Contains(err.Error(), "NO_ROUTE") {
+		t.Errorf("expected an error for an unroutable update, got %v", err)
+	}
+
+	broker.nack = true
+	expectUpdates(mock, "external-id", "update-2")
+	if err = a.Propagate(context.Background(), "external-id"); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("expected an error for a rejected update, got %v", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet database expectations: %s", err)
+	}
+}
+
+func TestAMQPPropagatorReconnects(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	brokers := []*fakeBroker{newFakeBroker(), newFakeBroker()}
+	var dials int
+	a := newAMQPPropagator(db, "de", "jobs.status-updates", func() (*amqpSession, error) {
+		if dials >= len(brokers) {
+			return nil, errors.New("too many connections")
+		}
+		dials++
+		return brokers[dials-1].dial()
+	})
+
+	expectUpdates(mock, "external-id", "update-1")
+	expectMarked(mock, "update-1")
+	if err = a.Propagate(context.Background(), "external-id"); err != nil {
+		t.Fatalf("error from Propagate(): %s", err)
+	}
+
+	// The broker closes the channel, so the next update is published on a
+	// new one.
+	brokers[0].closed <- amqp.ErrClosed
+	close(brokers[0].closed)
+
+	expectUpdates(mock, "external-id", "update-2")
+	expectMarked(mock, "update-2")
+	if err = a.Propagate(context.Background(), "external-id"); err != nil {
+		t.Fatalf("error from Propagate() after the channel was closed: %s", err)
+	}
+
+	if dials != 2 {
+		t.Errorf("connected to the broker %d times instead of 2", dials)
+	}
+	if len(brokers[0].published) != 1 || len(brokers[1].published) != 1 {
+		t.Errorf("published %d messages on the first channel and %d on the second instead of 1 each", len(brokers[0].published), len(brokers[1].published))
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet database expectations: %s", err)
+	}
+}
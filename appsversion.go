@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// compareVersions compares two dotted version numbers such as "2.9.0" or
+// "v2.10", returning -1, 0, or 1 if a is older than, the same as, or newer than
+// b. Missing components are treated as zero and anything after a hyphen or
+// plus sign is ignored.
+func compareVersions(a, b string) (int, error) {
+	parse := func(v string) ([]int, error) {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+		if i := strings.IndexAny(v, "-+"); i >= 0 {
+			v = v[:i]
+		}
+		var parts []int
+		for _, field := range strings.Split(v, ".") {
+			n, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid version number %q", v)
+			}
+			parts = append(parts, n)
+		}
+		return parts, nil
+	}
+
+	aParts, err := parse(a)
+	if err != nil {
+		return 0, err
+	}
+	bParts, err := parse(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var x, y int
+		if i < len(aParts) {
+			x = aParts[i]
+		}
+		if i < len(bParts) {
+			y = bParts[i]
+		}
+		if x < y {
+			return -1, nil
+		}
+		if x > y {
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// AppsVersion returns the version reported by {appsURI}/version. The response
+// may either be a JSON object with a "version" field or the plain version.
+func AppsVersion(ctx context.Context, client *http.Client, appsURI string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(appsURI, "/")+"/version", nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", maskURLError(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("version request to %s returned %s", MaskAppsURI(appsURI), resp.Status)
+	}
+
+	var info struct {
+		Version string `json:"version"`
+	}
+	if err = json.Unmarshal(body, &info); err == nil && info.Version != "" {
+		return info.Version, nil
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// CheckAppsVersion returns an error if the apps service at appsURI can't report
+// its version or if it's older than minVersion.
+func CheckAppsVersion(ctx context.Context, client *http.Client, appsURI, minVersion string) error {
+	version, err := AppsVersion(ctx, client, appsURI)
+	if err != nil {
+		return err
+	}
+
+	cmp, err := compareVersions(version, minVersion)
+	if err != nil {
+		return err
+	}
+
+	if cmp < 0 {
+		return fmt.Errorf("the apps service at %s is version %s, which is older than the minimum of %s", MaskAppsURI(appsURI), version, minVersion)
+	}
+
+	log.Infof("The apps service at %s is version %s", MaskAppsURI(appsURI), version)
+	return nil
+}
+
+// testJobUUID is sent in round-trip tests so that the apps service's logs show
+// that they aren't real updates.
+const testJobUUID = "00000000-0000-0000-0000-000000000000"
+
+// MeasureAppsRoundTrip sends a status update for testJobUUID to the apps
+// service and returns how long it took to get a response, along with the
+// response status. Any response counts, since the apps service won't know about
+// the test job. The update is signed with signingKey if it isn't empty, the
+// same way as real updates, and the client is expected to add any auth header.
+func MeasureAppsRoundTrip(ctx context.Context, client *http.Client, appsURI, method string, signingKey []byte) (time.Duration, string, error) {
+	msg, err := json.Marshal(JobStatusUpdate{UUID: testJobUUID})
+	if err != nil {
+		return 0, "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, appsURI, bytes.NewReader(msg))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("content-type", "application/json")
+	if len(signingKey) > 0 {
+		req.Header.Set(SignatureHeader, SignBody(signingKey, msg))
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", maskURLError(err)
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(io.Discard, resp.Body)
+	return time.Since(start), resp.Status, err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"2.9.0", "2.9.0", 0},
+		{"v2.10.0", "2.9.1", 1},
+		{"2.9", "2.9.1", -1},
+		{"3.0.0-rc1", "3.0.0", 0},
+	}
+
+	for _, test := range tests {
+		actual, err := compareVersions(test.a, test.b)
+		if err != nil {
+			t.Errorf("error comparing %s and %s: %s", test.a, test.b, err)
+		}
+		if actual != test.expected {
+			t.Errorf("comparing %s and %s returned %d instead of %d", test.a, test.b, actual, test.expected)
+		}
+	}
+
+	if _, err := compareVersions("latest", "2.9.0"); err == nil {
+		t.Error("expected an error comparing an invalid version")
+	}
+}
+
+func TestCheckAppsVersion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/callbacks/version" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"service": "apps", "version": "2.9.0"}`)
+	}))
+	defer server.Close()
+
+	appsURI := server.URL + "/callbacks"
+	if err := CheckAppsVersion(context.Background(), server.Client(), appsURI, "2.8.0"); err != nil {
+		t.Errorf("error calling CheckAppsVersion(): %s", err)
+	}
+
+	if err := CheckAppsVersion(context.Background(), server.Client(), appsURI, "2.10.0"); err == nil {
+		t.Error("expected an error for an apps service that's too old")
+	}
+}
+
+func TestMeasureAppsRoundTrip(t *testing.T) {
+	var body string
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		headers = r.Header
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	// The test update is authenticated and signed like a real one.
+	key := []byte("signing-key")
+	client := &http.Client{Transport: NewAuthRoundTripper(http.DefaultTransport, "Authorization", "s3cret")}
+	latency, status, err := MeasureAppsRoundTrip(context.Background(), client, server.URL, http.MethodPost, key)
+	if err != nil {
+		t.Fatalf("error calling MeasureAppsRoundTrip(): %s", err)
+	}
+	if latency <= 0 {
+		t.Errorf("latency was %s", latency)
+	}
+	if status != "404 Not Found" {
+		t.Errorf("status was %q instead of 404 Not Found", status)
+	}
+	if expected := `{"uuid":"00000000-0000-0000-0000-000000000000"}`; body != expected {
+		t.Errorf("request body was %s instead of %s", body, expected)
+	}
+	if actual := headers.Get("Authorization"); actual != "Bearer s3cret" {
+		t.Errorf("the Authorization header was %q instead of the bearer token", actual)
+	}
+	if actual, expected := headers.Get(SignatureHeader), SignBody(key, []byte(body)); actual != expected {
+		t.Errorf("the %s header was %q instead of %q", SignatureHeader, actual, expected)
+	}
+}
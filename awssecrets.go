@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/spf13/viper"
+)
+
+// SecretGetter is the part of the Secrets Manager client used by
+// MergeAWSSecret.
+type SecretGetter interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// NewSecretsManagerClient returns a Secrets Manager client for the region. The
+// credentials come from the default chain, so static credentials in the
+// environment or the shared credentials file are used if they're set and the
+// EC2 instance profile is used otherwise. An empty region falls back to the
+// region in the environment.
+func NewSecretsManagerClient(ctx context.Context, region string) (*secretsmanager.Client, error) {
+	var opts []func(*config.LoadOptions) error
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return secretsmanager.NewFromConfig(awsCfg), nil
+}
+
+// MergeAWSSecret retrieves the secret with the given ID and merges it into cfg.
+// The secret must be a JSON object with the same keys as the config file;
+// values in the secret take precedence over the ones in the file.
+func MergeAWSSecret(ctx context.Context, client SecretGetter, secretID string, cfg *viper.Viper) error {
+	out, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return err
+	}
+	if out.SecretString == nil {
+		return fmt.Errorf("secret %s has no string value", secretID)
+	}
+
+	var values map[string]any
+	if err = json.Unmarshal([]byte(*out.SecretString), &values); err != nil {
+		return fmt.Errorf("secret %s is not a JSON object: %w", secretID, err)
+	}
+	return cfg.MergeConfigMap(values)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/spf13/viper"
+)
+
+type stubSecretGetter struct {
+	secret *string
+	err    error
+	id     string
+}
+
+func (s *stubSecretGetter) GetSecretValue(_ context.Context, params *secretsmanager.GetSecretValueInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	s.id = aws.ToString(params.SecretId)
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: s.secret}, nil
+}
+
+func TestMergeAWSSecret(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("apps.callbacks_uri", "http://apps/callbacks")
+	cfg.Set("db.max_open_conns", 25)
+
+	client := &stubSecretGetter{secret: aws.String(`{"db": {"uri": "postgres://user:secret@db/de"}, "apps": {"auth_token": "s3cret"}}`)}
+	if err := MergeAWSSecret(context.Background(), client, "job-status", cfg); err != nil {
+		t.Fatalf("MergeAWSSecret returned an error: %s", err)
+	}
+
+	if client.id != "job-status" {
+		t.Errorf("the secret ID was %q instead of job-status", client.id)
+	}
+	expected := map[string]string{
+		"db.uri":             "postgres://user:secret@db/de",
+		"apps.auth_token":    "s3cret",
+		"apps.callbacks_uri": "http://apps/callbacks",
+	}
+	for key, value := range expected {
+		if actual := cfg.GetString(key); actual != value {
+			t.Errorf("%s was %q instead of %q", key, actual, value)
+		}
+	}
+	if actual := cfg.GetInt("db.max_open_conns"); actual != 25 {
+		t.Errorf("db.max_open_conns was %d instead of 25", actual)
+	}
+}
+
+func TestMergeAWSSecretErrors(t *testing.T) {
+	tests := []*stubSecretGetter{
+		{err: errors.New("access denied")},
+		{},
+		{secret: aws.String("not json")},
+	}
+
+	for _, client := range tests {
+		if err := MergeAWSSecret(context.Background(), client, "job-status", viper.New()); err == nil {
+			t.Errorf("MergeAWSSecret didn't return an error for %+v", client)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Backoff describes how long to wait between in-process retries of a
+// propagation.
+type Backoff struct {
+	// Retries is the number of times a transient failure is retried before
+	// it's reported. Zero disables in-process retries.
+	Retries int
+
+	// BaseDelay is the delay before the first retry.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the delay between retries.
+	MaxDelay time.Duration
+
+	// Multiplier is applied to the delay after each retry.
+	Multiplier float64
+}
+
+// Delay returns how long to wait before the given retry, counting from zero.
+// The delay grows exponentially up to MaxDelay, and a random amount of up to
+// half of it is subtracted so that concurrent retries don't line up.
+func (b Backoff) Delay(retry int) time.Duration {
+	delay := float64(b.BaseDelay) * math.Pow(b.Multiplier, float64(retry))
+	if b.MaxDelay > 0 && delay > float64(b.MaxDelay) {
+		delay = float64(b.MaxDelay)
+	}
+	if delay < 1 {
+		return 0
+	}
+	half := int64(delay / 2)
+	return time.Duration(int64(delay) - rand.Int63n(half+1))
+}
+
+// IsTransient returns true if the error looks like it was caused by a
+// temporary problem with the apps service: a 5xx or 429 response, a timeout, a
+// failed dial, read or write such as a refused or reset connection, or a
+// connection that closed before the response was read. Other errors from the
+// HTTP client, e.g. bad certificates or malformed URIs, aren't transient even
+// though *url.Error implements net.Error.
+func IsTransient(err error) bool {
+	var respErr *ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode >= 500 || respErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// RetryingPropagator retries transient failures from another JobPropagator
+// with exponential backoff. Only the final failure is returned, so the
+// propagation_attempts column only counts attempts that used up all of the
+// in-process retries.
+type RetryingPropagator struct {
+	propagator JobPropagator
+	backoff    Backoff
+}
+
+// NewRetryingPropagator returns a *RetryingPropagator that retries failures
+// from p according to b.
+func NewRetryingPropagator(p JobPropagator, b Backoff) *RetryingPropagator {
+	return &RetryingPropagator{propagator: p, backoff: b}
+}
+
+// Propagate pushes the update to the apps service, retrying transient
+// failures until the retries are used up, the pass's retry budget runs out, or
+// the context is done.
+func (r *RetryingPropagator) Propagate(ctx context.Context, uuid string) error {
+	log := loggerFromContext(ctx)
+
+	err := r.propagator.Propagate(ctx, uuid)
+	for retry := 0; retry < r.backoff.Retries && err != nil && IsTransient(err); retry++ {
+		if !retryBudgetFromContext(ctx).Take() {
+			log.Debugf("Retry budget exhausted; not retrying job %s again in this pass", uuid)
+			return err
+		}
+
+		delay := r.backoff.Delay(retry)
+		log.Warnf("Transient error propagating job %s; retrying in %s: %s", uuid, delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+
+		err = r.propagator.Propagate(ctx, uuid)
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second, Multiplier: 2}
+
+	tests := []struct {
+		retry    int
+		expected time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{2, 400 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{4, time.Second},
+		{10, time.Second},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			delay := b.Delay(test.retry)
+			if delay > test.expected || delay < test.expected/2 {
+				t.Fatalf("Delay(%d) returned %s, which isn't between %s and %s", test.retry, delay, test.expected/2, test.expected)
+			}
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{pkgerrors.WithStack(&ResponseError{StatusCode: 503}), true},
+		{pkgerrors.WithStack(&ResponseError{StatusCode: 500}), true},
+		{pkgerrors.WithStack(&ResponseError{StatusCode: 429}), true},
+		{pkgerrors.WithStack(&ResponseError{StatusCode: 400}), false},
+		{pkgerrors.WithStack(&ResponseError{StatusCode: 404}), false},
+		{NewStructuredError("job-1", &net.OpError{Op: "dial", Err: errors.New("connection refused")}), true},
+		{&url.Error{Op: "Post", URL: "http://apps", Err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}}, true},
+		{&url.Error{Op: "Post", URL: "http://apps", Err: io.EOF}, true},
+		{&url.Error{Op: "Post", URL: "http://apps", Err: context.DeadlineExceeded}, true},
+		{&url.Error{Op: "Post", URL: "http://apps", Err: &net.DNSError{Err: "no such host", Name: "apps", IsNotFound: true}}, false},
+		{&url.Error{Op: "Post", URL: "https://apps", Err: x509.UnknownAuthorityError{}}, false},
+		{&url.Error{Op: "Post", URL: "ftp://apps", Err: errors.New(`unsupported protocol scheme "ftp"`)}, false},
+		{errors.New("sql: database is closed"), false},
+	}
+
+	for _, test := range tests {
+		if actual := IsTransient(test.err); actual != test.expected {
+			t.Errorf("IsTransient(%v) returned %t instead of %t", test.err, actual, test.expected)
+		}
+	}
+}
+
+// sequencePropagator returns the errors in order, then nil.
+type sequencePropagator struct {
+	errs  []error
+	calls int
+}
+
+func (s *sequencePropagator) Propagate(ctx context.Context, uuid string) error {
+	s.calls++
+	if len(s.errs) == 0 {
+		return nil
+	}
+	err := s.errs[0]
+	s.errs = s.errs[1:]
+	return err
+}
+
+func TestRetryingPropagator(t *testing.T) {
+	unavailable := &ResponseError{StatusCode: 503, Status: "503 Service Unavailable"}
+	badRequest := &ResponseError{StatusCode: 400, Status: "400 Bad Request"}
+	b := Backoff{Retries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Multiplier: 2}
+
+	tests := []struct {
+		name     string
+		errs     []error
+		expected error
+		calls    int
+	}{
+		{"success", nil, nil, 1},
+		{"recovered", []error{unavailable, unavailable}, nil, 3},
+		{"exhausted", []error{unavailable, unavailable, unavailable}, unavailable, 3},
+		{"permanent", []error{badRequest}, badRequest, 1},
+	}
+
+	for _, test := range tests {
+		inner := &sequencePropagator{errs: test.errs}
+		err := NewRetryingPropagator(inner, b).Propagate(context.Background(), "job-1")
+		if err != test.expected {
+			t.Errorf("%s: Propagate() returned %v instead of %v", test.name, err, test.expected)
+		}
+		if inner.calls != test.calls {
+			t.Errorf("%s: made %d calls instead of %d", test.name, inner.calls, test.calls)
+		}
+	}
+}
+
+func TestRetryingPropagatorRetryBudget(t *testing.T) {
+	unavailable := &ResponseError{StatusCode: 503, Status: "503 Service Unavailable"}
+	b := Backoff{Retries: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Multiplier: 2}
+
+	// Each in-process retry takes from the pass's budget.
+	budget := NewRetryBudget(1)
+	ctx := WithRetryBudget(context.Background(), budget)
+	inner := &sequencePropagator{errs: []error{unavailable, unavailable, unavailable}}
+	if err := NewRetryingPropagator(inner, b).Propagate(ctx, "job-1"); err != unavailable {
+		t.Errorf("Propagate() returned %v instead of %v", err, unavailable)
+	}
+	if inner.calls != 2 {
+		t.Errorf("made %d calls instead of 2", inner.calls)
+	}
+	if !budget.Exhausted() {
+		t.Error("the retry budget should be exhausted")
+	}
+}
+
+func TestRetryingPropagatorStopsWhenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	inner := &sequencePropagator{errs: []error{&ResponseError{StatusCode: 503}}}
+	b := Backoff{Retries: 5, BaseDelay: time.Hour, MaxDelay: time.Hour, Multiplier: 2}
+	if err := NewRetryingPropagator(inner, b).Propagate(ctx, "job-1"); err == nil {
+		t.Error("Propagate() didn't return the error after the context was canceled")
+	}
+	if inner.calls != 1 {
+		t.Errorf("made %d calls instead of 1", inner.calls)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backpressure is an overload signal sent by the apps service in the
+// X-Backpressure response header, either "slow-down" or "pause-<duration>",
+// e.g. "pause-30s".
+type Backpressure struct {
+	SlowDown bool
+	Pause    time.Duration
+}
+
+// ParseBackpressure parses the value of an X-Backpressure header.
+func ParseBackpressure(value string) (Backpressure, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "slow-down" {
+		return Backpressure{SlowDown: true}, nil
+	}
+
+	if d, ok := strings.CutPrefix(value, "pause-"); ok {
+		pause, err := time.ParseDuration(d)
+		if err != nil || pause <= 0 {
+			return Backpressure{}, fmt.Errorf("invalid pause duration in X-Backpressure header %q", value)
+		}
+		return Backpressure{Pause: pause}, nil
+	}
+
+	return Backpressure{}, fmt.Errorf("unrecognized X-Backpressure header %q", value)
+}
+
+// PauseGate holds up new propagations until a pause ends.
+type PauseGate struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// PauseFor pauses propagation for d, unless it's already paused for longer.
+func (g *PauseGate) PauseFor(d time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if until := time.Now().Add(d); until.After(g.until) {
+		g.until = until
+	}
+}
+
+// Wait blocks until the pause ends or the context is done, in which case it
+// returns the context's error.
+func (g *PauseGate) Wait(ctx context.Context) error {
+	for {
+		g.mu.Lock()
+		remaining := time.Until(g.until)
+		g.mu.Unlock()
+
+		if remaining <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(remaining)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
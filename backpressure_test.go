@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseBackpressure(t *testing.T) {
+	tests := map[string]Backpressure{
+		"slow-down":  {SlowDown: true},
+		" Pause-30s": {Pause: 30 * time.Second},
+		"pause-1m":   {Pause: time.Minute},
+	}
+	for value, expected := range tests {
+		actual, err := ParseBackpressure(value)
+		if err != nil {
+			t.Errorf("error parsing %q: %s", value, err)
+		}
+		if actual != expected {
+			t.Errorf("ParseBackpressure(%q) returned %+v instead of %+v", value, actual, expected)
+		}
+	}
+
+	for _, value := range []string{"", "stop", "pause-", "pause-forever", "pause--5s"} {
+		if _, err := ParseBackpressure(value); err == nil {
+			t.Errorf("expected an error parsing %q", value)
+		}
+	}
+}
+
+func TestPauseGate(t *testing.T) {
+	g := &PauseGate{}
+	if err := g.Wait(context.Background()); err != nil {
+		t.Errorf("error waiting on an open gate: %s", err)
+	}
+
+	g.PauseFor(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := g.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wait() returned %v instead of %v while paused", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// CertificateRotator is an http.RoundTripper that presents a client certificate
+// to the apps service. It watches the certificate and key files and rebuilds the
+// underlying transport whenever they change, so that rotated certificates are
+// picked up without restarting the service.
+type CertificateRotator struct {
+	certFile     string
+	keyFile      string
+	newTransport func(*tls.Config) (http.RoundTripper, error)
+
+	mu        sync.RWMutex
+	transport http.RoundTripper
+}
+
+// NewCertificateRotator returns a *CertificateRotator for the given certificate
+// and key files. The newTransport function is called with the TLS configuration
+// each time the certificate is loaded.
+func NewCertificateRotator(certFile, keyFile string, newTransport func(*tls.Config) (http.RoundTripper, error)) (*CertificateRotator, error) {
+	r := &CertificateRotator{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		newTransport: newTransport,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// RoundTrip sends the request using the current transport.
+func (r *CertificateRotator) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.RLock()
+	transport := r.transport
+	r.mu.RUnlock()
+	return transport.RoundTrip(req)
+}
+
+// Reload loads the certificate and key and replaces the current transport with
+// one that uses them. The current transport is kept if they can't be loaded.
+func (r *CertificateRotator) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	transport, err := r.newTransport(&tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	old := r.transport
+	r.transport = transport
+	r.mu.Unlock()
+
+	if closer, ok := old.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+	return nil
+}
+
+// Watch reloads the certificate whenever anything changes in the directories
+// containing the certificate and key files. Directories are watched rather than
+// the files themselves because Kubernetes updates mounted secrets by swapping a
+// symlink. Watch blocks until the context is cancelled.
+func (r *CertificateRotator) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for _, dir := range []string{filepath.Dir(r.certFile), filepath.Dir(r.keyFile)} {
+		if err = watcher.Add(dir); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				log.Errorf("Error reloading the apps client certificate after %s: %s", event, err)
+				continue
+			}
+			log.Infof("Reloaded the apps client certificate from %s", r.certFile)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Errorf("Error watching the apps client certificate: %s", err)
+		}
+	}
+}
+
+// LoadCAPool returns a certificate pool containing only the PEM-encoded CA
+// certificates in the file, for verifying the apps service's certificate
+// instead of the system roots.
+func LoadCAPool(path string) (*x509.CertPool, error) {
+	pemCerts, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return nil, fmt.Errorf("no PEM-encoded certificates found in %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate with the given common
+// name and its key to certFile and keyFile.
+func writeTestCertificate(t *testing.T, commonName, certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %s", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("error marshalling key: %s", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err = os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("error writing certificate: %s", err)
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err = os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("error writing key: %s", err)
+	}
+}
+
+func TestCertificateRotatorReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeTestCertificate(t, "first", certFile, keyFile)
+
+	var commonName string
+	newTransport := func(cfg *tls.Config) (http.RoundTripper, error) {
+		leaf, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		commonName = leaf.Subject.CommonName
+		return http.DefaultTransport.(*http.Transport).Clone(), nil
+	}
+
+	r, err := NewCertificateRotator(certFile, keyFile, newTransport)
+	if err != nil {
+		t.Fatalf("error calling NewCertificateRotator(): %s", err)
+	}
+
+	if commonName != "first" {
+		t.Errorf("loaded certificate was %s instead of first", commonName)
+	}
+
+	writeTestCertificate(t, "second", certFile, keyFile)
+	if err = r.Reload(); err != nil {
+		t.Fatalf("error calling Reload(): %s", err)
+	}
+
+	if commonName != "second" {
+		t.Errorf("reloaded certificate was %s instead of second", commonName)
+	}
+
+	if err = os.WriteFile(certFile, []byte("garbage"), 0600); err != nil {
+		t.Fatalf("error writing certificate: %s", err)
+	}
+	if err = r.Reload(); err == nil {
+		t.Error("expected an error reloading an invalid certificate")
+	}
+}
+
+func TestLoadCAPool(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatalf("error writing the CA file: %s", err)
+	}
+
+	pool, err := LoadCAPool(caFile)
+	if err != nil {
+		t.Fatalf("error calling LoadCAPool(): %s", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Fatalf("the server's certificate wasn't trusted: %s", err)
+	}
+	resp.Body.Close()
+
+	if err = os.WriteFile(caFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("error writing the CA file: %s", err)
+	}
+	if _, err = LoadCAPool(caFile); err == nil {
+		t.Error("LoadCAPool() didn't return an error for a file without certificates")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// Checkpoint persists the IDs of the jobs in the batch that's being propagated,
+// so that the jobs that were in progress when the service crashed can be
+// propagated first when it restarts. A nil *Checkpoint doesn't persist
+// anything.
+type Checkpoint struct {
+	path string
+}
+
+// NewCheckpoint returns a *Checkpoint that's stored in the file at path.
+func NewCheckpoint(path string) *Checkpoint {
+	return &Checkpoint{path: path}
+}
+
+// Save replaces the checkpoint with the jobs. The file is written atomically by
+// writing a temporary file and renaming it, so a crash can't leave a partial
+// checkpoint behind.
+func (c *Checkpoint) Save(jobs []string) error {
+	if c == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(jobs)
+	if err != nil {
+		return err
+	}
+
+	tmp := c.path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// Load returns the jobs in the checkpoint, or nil if there isn't one.
+func (c *Checkpoint) Load() ([]string, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(c.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []string
+	if err = json.Unmarshal(b, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Remove deletes the checkpoint once its jobs have been propagated.
+func (c *Checkpoint) Remove() error {
+	if c == nil {
+		return nil
+	}
+	if err := os.Remove(c.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	c := NewCheckpoint(path)
+
+	jobs, err := c.Load()
+	if err != nil {
+		t.Fatalf("Load returned an error without a checkpoint: %s", err)
+	}
+	if jobs != nil {
+		t.Errorf("Load returned %v without a checkpoint", jobs)
+	}
+
+	expected := []string{"job-1", "job-2"}
+	if err = c.Save(expected); err != nil {
+		t.Fatalf("Save returned an error: %s", err)
+	}
+	if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Error("the temporary file was left behind")
+	}
+
+	if jobs, err = NewCheckpoint(path).Load(); err != nil {
+		t.Fatalf("Load returned an error: %s", err)
+	}
+	if !reflect.DeepEqual(jobs, expected) {
+		t.Errorf("Load returned %v instead of %v", jobs, expected)
+	}
+
+	if err = c.Remove(); err != nil {
+		t.Fatalf("Remove returned an error: %s", err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Error("the checkpoint file wasn't removed")
+	}
+	if err = c.Remove(); err != nil {
+		t.Errorf("Remove returned an error without a checkpoint: %s", err)
+	}
+}
+
+func TestNilCheckpoint(t *testing.T) {
+	var c *Checkpoint
+	if err := c.Save([]string{"job-1"}); err != nil {
+		t.Errorf("Save returned an error: %s", err)
+	}
+	if jobs, err := c.Load(); err != nil || jobs != nil {
+		t.Errorf("Load returned %v, %v", jobs, err)
+	}
+	if err := c.Remove(); err != nil {
+		t.Errorf("Remove returned an error: %s", err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of sending an update while the circuit
+// breaker for an apps service instance is open, so that callers can tell that
+// the service is down rather than that the job failed.
+var ErrCircuitOpen = errors.New("the circuit breaker for the apps service is open")
+
+// CircuitState is the state of a CircuitBreaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets every request through.
+	CircuitClosed CircuitState = iota
+
+	// CircuitHalfOpen lets a single request through to test whether the
+	// service has recovered.
+	CircuitHalfOpen
+
+	// CircuitOpen rejects every request until the cool-down period is over.
+	CircuitOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitHalfOpen:
+		return "half-open"
+	case CircuitOpen:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreakerSettings configures the circuit breakers created for each apps
+// service instance.
+type CircuitBreakerSettings struct {
+	// Threshold is the number of consecutive failures within Window that opens
+	// the circuit. Zero disables the circuit breaker.
+	Threshold int
+
+	// Window is how far back failures are counted.
+	Window time.Duration
+
+	// CoolDown is how long the circuit stays open before a request is let
+	// through to test the service.
+	CoolDown time.Duration
+}
+
+// CircuitBreaker stops requests to a service that keeps failing. It opens after
+// Threshold consecutive failures within Window, rejects requests for CoolDown,
+// and then lets a single request through. The circuit closes again if that
+// request succeeds and reopens if it fails. It's safe for concurrent use.
+type CircuitBreaker struct {
+	settings CircuitBreakerSettings
+	now      func() time.Time
+
+	mu        sync.Mutex
+	state     CircuitState
+	failures  []time.Time
+	nextRetry time.Time
+	probing   bool
+}
+
+// NewCircuitBreaker returns a closed *CircuitBreaker.
+func NewCircuitBreaker(settings CircuitBreakerSettings) *CircuitBreaker {
+	return &CircuitBreaker{settings: settings, now: time.Now}
+}
+
+// State returns the current state of the circuit.
+func (c *CircuitBreaker) State() CircuitState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// Allow returns ErrCircuitOpen if a request shouldn't be sent right now. Each
+// call that returns nil must be followed by a call to Record.
+func (c *CircuitBreaker) Allow() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case CircuitOpen:
+		if c.now().Before(c.nextRetry) {
+			return ErrCircuitOpen
+		}
+		c.state = CircuitHalfOpen
+		c.probing = true
+		return nil
+	case CircuitHalfOpen:
+		if c.probing {
+			return ErrCircuitOpen
+		}
+		c.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// Record updates the circuit with the outcome of a request.
+func (c *CircuitBreaker) Record(success bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if c.state == CircuitHalfOpen {
+		c.probing = false
+		if success {
+			log.Info("The apps service recovered; closing the circuit breaker")
+			c.state = CircuitClosed
+			c.failures = nil
+		} else {
+			c.open(now)
+		}
+		return
+	}
+
+	if success {
+		c.failures = nil
+		return
+	}
+
+	// Only keep the consecutive failures that are still within the window.
+	c.failures = append(c.failures, now)
+	for len(c.failures) > 0 && now.Sub(c.failures[0]) > c.settings.Window {
+		c.failures = c.failures[1:]
+	}
+	if c.state == CircuitClosed && len(c.failures) >= c.settings.Threshold {
+		log.Warnf("%d consecutive failures from the apps service; opening the circuit breaker for %s", len(c.failures), c.settings.CoolDown)
+		c.open(now)
+	}
+}
+
+// open opens the circuit until the cool-down period is over. The caller must
+// hold the lock.
+func (c *CircuitBreaker) open(now time.Time) {
+	c.state = CircuitOpen
+	c.nextRetry = now.Add(c.settings.CoolDown)
+	c.failures = nil
+}
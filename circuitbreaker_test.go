@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	c := NewCircuitBreaker(CircuitBreakerSettings{Threshold: 3, Window: time.Minute, CoolDown: 30 * time.Second})
+	c.now = func() time.Time { return now }
+
+	fail := func() {
+		t.Helper()
+		if err := c.Allow(); err != nil {
+			t.Fatalf("Allow() returned %v in the %s state", err, c.State())
+		}
+		c.Record(false)
+	}
+
+	// A success resets the count of consecutive failures.
+	fail()
+	fail()
+	c.Record(true)
+	fail()
+	fail()
+	if c.State() != CircuitClosed {
+		t.Fatalf("the circuit is %s after 2 consecutive failures", c.State())
+	}
+
+	// Failures outside of the window don't count.
+	now = now.Add(2 * time.Minute)
+	fail()
+	if c.State() != CircuitClosed {
+		t.Fatalf("the circuit is %s after failures outside of the window", c.State())
+	}
+	fail()
+	fail()
+	if c.State() != CircuitOpen {
+		t.Fatalf("the circuit is %s instead of open", c.State())
+	}
+	if err := c.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Allow() returned %v while the circuit is open", err)
+	}
+
+	// A single request is let through after the cool-down period.
+	now = now.Add(31 * time.Second)
+	if err := c.Allow(); err != nil {
+		t.Fatalf("Allow() returned %v after the cool-down period", err)
+	}
+	if c.State() != CircuitHalfOpen {
+		t.Errorf("the circuit is %s instead of half-open", c.State())
+	}
+	if err := c.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Allow() let a second request through while half-open")
+	}
+
+	// A failed probe reopens the circuit and a successful one closes it.
+	c.Record(false)
+	if c.State() != CircuitOpen {
+		t.Fatalf("the circuit is %s after a failed probe", c.State())
+	}
+	now = now.Add(31 * time.Second)
+	if err := c.Allow(); err != nil {
+		t.Fatalf("Allow() returned %v after the cool-down period", err)
+	}
+	c.Record(true)
+	if c.State() != CircuitClosed {
+		t.Errorf("the circuit is %s after a successful probe", c.State())
+	}
+}
+
+func TestPropagateCircuitBreaker(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	p, err := NewPropagator(db, server.URL, &PropagatorOptions{
+		CircuitBreaker: CircuitBreakerSettings{Threshold: 2, Window: time.Minute, CoolDown: time.Minute},
+	})
+	if err != nil {
+		t.Fatalf("error calling NewPropagator(): %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		expectUpdates(mock, "external-id", "update-1")
+		err = p.Propagate(context.Background(), "external-id")
+	}
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Propagate() returned %v instead of ErrCircuitOpen", err)
+	}
+	if calls != 2 {
+		t.Errorf("the apps service was called %d times instead of 2", calls)
+	}
+}
+
+func TestHandleDefersWhenCircuitOpen(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	stats := &PropagationStats{}
+	h := &jobHandler{db: db, maxRetries: 3, propagator: &stubPropagator{err: ErrCircuitOpen}, stats: stats}
+	h.handle(context.Background(), "job-1", 0, NewRetryBudget(0))
+
+	if stats.Deferred.Load() != 1 || stats.Failed.Load() != 0 {
+		t.Errorf("the job wasn't deferred: %+v", stats.snapshot())
+	}
+
+	// The attempt isn't recorded in the database.
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// AIMDConcurrencyController limits the number of concurrent propagations using
+// additive increase, multiplicative decrease: the limit grows by one after each
+// batch that mostly succeeds and is halved after each batch with too many
+// failures, so it settles around what the apps service can handle.
+type AIMDConcurrencyController struct {
+	maxConcurrency   int
+	failureThreshold float64
+
+	mu      sync.Mutex
+	current int
+}
+
+// NewAIMDConcurrencyController returns a controller that starts at initial and
+// never goes above maxConcurrency. Batches where more than failureThresholdPct
+// percent of the propagations fail halve the limit.
+func NewAIMDConcurrencyController(initial, maxConcurrency int, failureThresholdPct float64) *AIMDConcurrencyController {
+	c := &AIMDConcurrencyController{
+		maxConcurrency:   maxConcurrency,
+		failureThreshold: failureThresholdPct / 100,
+		current:          min(max(initial, 1), maxConcurrency),
+	}
+	currentConcurrency.Set(float64(c.current))
+	return c
+}
+
+// Limit returns the current concurrency limit.
+func (c *AIMDConcurrencyController) Limit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current
+}
+
+// Update adjusts the limit based on the outcome of a batch.
+func (c *AIMDConcurrencyController) Update(succeeded, failed int64) {
+	total := succeeded + failed
+	if total == 0 {
+		return
+	}
+
+	if float64(failed)/float64(total) > c.failureThreshold {
+		c.Decrease()
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current = min(c.current+1, c.maxConcurrency)
+	currentConcurrency.Set(float64(c.current))
+}
+
+// Decrease halves the limit, down to a minimum of one.
+func (c *AIMDConcurrencyController) Decrease() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current = max(c.current/2, 1)
+	currentConcurrency.Set(float64(c.current))
+	log.Infof("Reduced the propagation concurrency to %d", c.current)
+}
+
+// ConcurrentPropagator handles the jobs in a batch with a fixed pool of worker
+// goroutines instead of a goroutine per job. The jobs are dealt out to a queue
+// for each worker in turn. A worker that runs out of jobs steals them from the
+// deepest of the other queues, so one slow job doesn't hold up the jobs queued
+// behind it while other workers sit idle.
+type ConcurrentPropagator struct {
+	workers int
+	handle  func(ctx context.Context, jobExtID string)
+}
+
+// NewConcurrentPropagator returns a *ConcurrentPropagator that calls handle for
+// each job using the given number of workers.
+func NewConcurrentPropagator(workers int, handle func(ctx context.Context, jobExtID string)) *ConcurrentPropagator {
+	return &ConcurrentPropagator{workers: max(workers, 1), handle: handle}
+}
+
+// Run handles each of the jobs and returns once they're done. Jobs that are
+// still queued when the context is cancelled are skipped.
+func (c *ConcurrentPropagator) Run(ctx context.Context, jobs []string) {
+	if len(jobs) == 0 {
+		return
+	}
+
+	workers := min(c.workers, len(jobs))
+	queues := make([]chan string, workers)
+	for i := range queues {
+		queues[i] = make(chan string, (len(jobs)+workers-1)/workers)
+	}
+	for i, jobExtID := range jobs {
+		queues[i%workers] <- jobExtID
+	}
+	for _, q := range queues {
+		close(q)
+	}
+
+	var wg sync.WaitGroup
+	for i := range queues {
+		wg.Add(1)
+		go func(own chan string) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				jobExtID, ok := <-own
+				if !ok {
+					if jobExtID, ok = steal(queues); !ok {
+						return
+					}
+				}
+				c.handle(ctx, jobExtID)
+			}
+		}(queues[i])
+	}
+	wg.Wait()
+}
+
+// steal takes a job from the deepest of the queues. It returns false once all
+// of the queues are empty.
+func steal(queues []chan string) (string, bool) {
+	for {
+		var deepest chan string
+		for _, q := range queues {
+			if deepest == nil || len(q) > len(deepest) {
+				deepest = q
+			}
+		}
+		if len(deepest) == 0 {
+			return "", false
+		}
+		// Another worker may have emptied the queue in the meantime, in
+		// which case the next deepest one is tried.
+		if jobExtID, ok := <-deepest; ok {
+			return jobExtID, true
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAIMDConcurrencyController(t *testing.T) {
+	c := NewAIMDConcurrencyController(4, 6, 20)
+
+	steps := []struct {
+		succeeded, failed int64
+		expected          int
+	}{
+		{10, 0, 5},
+		{10, 2, 6}, // 17% failures is under the threshold.
+		{10, 0, 6}, // Capped at the maximum.
+		{7, 3, 3},  // 30% failures halves the limit.
+		{0, 0, 3},  // Empty batches don't change anything.
+		{0, 10, 1}, // Halved again.
+		{0, 10, 1}, // Never below one.
+	}
+
+	for i, step := range steps {
+		c.Update(step.succeeded, step.failed)
+		if actual := c.Limit(); actual != step.expected {
+			t.Errorf("step %d: limit was %d instead of %d", i, actual, step.expected)
+		}
+		if actual := testutil.ToFloat64(currentConcurrency); actual != float64(step.expected) {
+			t.Errorf("step %d: current_concurrency was %f instead of %d", i, actual, step.expected)
+		}
+	}
+}
+
+func TestConcurrentPropagator(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		handled []string
+		running atomic.Int64
+		peak    atomic.Int64
+	)
+	p := NewConcurrentPropagator(3, func(ctx context.Context, jobExtID string) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			old := peak.Load()
+			if n <= old || peak.CompareAndSwap(old, n) {
+				break
+			}
+		}
+
+		// The first job is slow so that the other workers have to steal the
+		// jobs queued behind it.
+		if jobExtID == "0" {
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		mu.Lock()
+		handled = append(handled, jobExtID)
+		mu.Unlock()
+	})
+
+	jobs := []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"}
+	p.Run(context.Background(), jobs)
+
+	sort.Strings(handled)
+	if len(handled) != len(jobs) {
+		t.Fatalf("%d jobs were handled instead of %d", len(handled), len(jobs))
+	}
+	for i := range jobs {
+		if handled[i] != jobs[i] {
+			t.Errorf("handled jobs were %v instead of %v", handled, jobs)
+			break
+		}
+	}
+	if actual := peak.Load(); actual > 3 {
+		t.Errorf("%d jobs were handled at once instead of at most 3", actual)
+	}
+
+	// Nothing should be handled once the context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	handled = nil
+	p.Run(ctx, jobs)
+	if len(handled) != 0 {
+		t.Errorf("%d jobs were handled after the context was cancelled", len(handled))
+	}
+}
+
+func TestConcurrentPropagatorStealing(t *testing.T) {
+	release := make(chan struct{})
+	var others atomic.Int64
+	p := NewConcurrentPropagator(2, func(ctx context.Context, jobExtID string) {
+		if jobExtID == "0" {
+			<-release
+			return
+		}
+		if others.Add(1) == 5 {
+			close(release)
+		}
+	})
+
+	// Jobs 0, 2, 4 are queued for the first worker, which blocks on job 0
+	// until the second worker has handled every other job, including the ones
+	// it had to steal.
+	done := make(chan struct{})
+	go func() {
+		p.Run(context.Background(), []string{"0", "1", "2", "3", "4", "5"})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the idle worker didn't steal the blocked worker's jobs")
+	}
+}
+
+func TestConcurrentPropagatorTimeout(t *testing.T) {
+	p := NewConcurrentPropagator(2, func(ctx context.Context, jobExtID string) {
+		<-ctx.Done()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx, []string{"1", "2", "3"})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after the context's deadline")
+	}
+}
+
+func TestConcurrentPropagatorPassTimeoutRecordsFailures(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	h := &jobHandler{db: db, maxRetries: 3, propagator: blockingPropagator{}, stats: &PropagationStats{}}
+	p := NewConcurrentPropagator(1, func(ctx context.Context, jobExtID string) {
+		h.handle(ctx, jobExtID, 0, NewRetryBudget(0))
+	})
+
+	// The job in flight when the pass times out still has its attempt
+	// recorded, but the job queued behind it isn't started.
+	mock.ExpectExec("set propagation_attempts = propagation_attempts \\+ 1").
+		WithArgs("job-1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	p.Run(ctx, []string{"job-1", "job-2"})
+
+	if actual := h.stats.Failed.Load(); actual != 1 {
+		t.Errorf("recorded %d failures instead of 1", actual)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
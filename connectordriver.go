@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+)
+
+// ConnectorDriver is a database/sql driver whose connections come from a
+// driver.Connector. Registering one lets a connector that wraps lib/pq's, such
+// as a *FailoverConnector or a *QueryLogConnector, be opened by name with
+// dbutil, which keeps retrying the connection while the database starts up.
+type ConnectorDriver struct {
+	connector driver.Connector
+}
+
+// NewConnectorDriver returns a *ConnectorDriver that connects with c.
+func NewConnectorDriver(c driver.Connector) *ConnectorDriver {
+	return &ConnectorDriver{connector: c}
+}
+
+// Open returns a new connection from the connector. The name is ignored.
+func (d *ConnectorDriver) Open(string) (driver.Conn, error) {
+	return d.connector.Connect(context.Background())
+}
+
+// OpenConnector returns the connector. The name is ignored.
+func (d *ConnectorDriver) OpenConnector(string) (driver.Connector, error) {
+	return d.connector, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+)
+
+// countingConnector counts the connections made by the wrapped connector.
+type countingConnector struct {
+	driver.Connector
+	connects int
+}
+
+func (c *countingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.connects++
+	return c.Connector.Connect(ctx)
+}
+
+func TestConnectorDriver(t *testing.T) {
+	connector := &countingConnector{Connector: &fakeConnector{}}
+	sql.Register("connector-driver-test", NewConnectorDriver(connector))
+
+	db, err := sql.Open("connector-driver-test", "postgres://ignored")
+	if err != nil {
+		t.Fatalf("error opening the database: %s", err)
+	}
+	defer db.Close()
+
+	if err = db.Ping(); err != nil {
+		t.Fatalf("error pinging the database: %s", err)
+	}
+	if connector.connects != 1 {
+		t.Errorf("the connector was used %d times instead of once", connector.connects)
+	}
+}
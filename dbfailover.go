@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// pqConn lists the interfaces implemented by lib/pq connections that
+// database/sql uses.
+type pqConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.QueryerContext
+	driver.ExecerContext
+	driver.Pinger
+	driver.SessionResetter
+	driver.Validator
+}
+
+// FailoverConnector is a driver.Connector that connects to the first of a list
+// of databases that's reachable, starting with the primary. New connections go
+// to the active database until it fails, at which point the connector fails
+// over to the next reachable database in the list. Connections to a database
+// that's no longer active are discarded when they're returned to the pool.
+type FailoverConnector struct {
+	names      []string
+	connectors []driver.Connector
+	active     atomic.Int64
+}
+
+// NewFailoverConnector returns a FailoverConnector for the primary database URI
+// followed by the failover URIs, in the order they should be tried.
+func NewFailoverConnector(uris []string) (*FailoverConnector, error) {
+	c := &FailoverConnector{}
+	for _, uri := range uris {
+		c.names = append(c.names, MaskDBURI(uri))
+		connector, err := pq.NewConnector(uri)
+		if err != nil {
+			return nil, err
+		}
+		c.connectors = append(c.connectors, connector)
+	}
+	return c, nil
+}
+
+// failoverConn is a connection to one of a FailoverConnector's databases.
+type failoverConn struct {
+	pqConn
+	c     *FailoverConnector
+	index int64
+}
+
+// IsValid returns false once the connection's database is no longer the active
+// one, so that database/sql closes it instead of reusing it.
+func (fc *failoverConn) IsValid() bool {
+	return fc.c.active.Load() == fc.index && fc.pqConn.IsValid()
+}
+
+// name returns the masked URI of the database at the given index for logging.
+func (c *FailoverConnector) name(index int64) string {
+	if int(index) < len(c.names) {
+		return c.names[index]
+	}
+	return fmt.Sprintf("database %d", index+1)
+}
+
+// dial connects to the database at the given index.
+func (c *FailoverConnector) dial(ctx context.Context, index int64) (driver.Conn, error) {
+	conn, err := c.connectors[index].Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if pc, ok := conn.(pqConn); ok {
+		return &failoverConn{pqConn: pc, c: c, index: index}, nil
+	}
+	return conn, nil
+}
+
+// Connect returns a connection to the active database, failing over to the
+// other databases in order if it can't be reached.
+func (c *FailoverConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	active := c.active.Load()
+	conn, err := c.dial(ctx, active)
+	if err == nil {
+		return conn, nil
+	}
+	errs := []error{err}
+
+	for i := range c.connectors {
+		index := int64(i)
+		if index == active {
+			continue
+		}
+
+		conn, err = c.dial(ctx, index)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if c.active.CompareAndSwap(active, index) {
+			log.Warnf("Failed over from %s to %s: %s", c.name(active), c.name(index), errs[0])
+			dbFailovers.Inc()
+		}
+		return conn, nil
+	}
+
+	return nil, fmt.Errorf("unable to connect to any of the %d databases: %w", len(c.connectors), errors.Join(errs...))
+}
+
+// Driver returns the lib/pq driver.
+func (c *FailoverConnector) Driver() driver.Driver {
+	return c.connectors[0].Driver()
+}
+
+// checkPrimary makes the primary database active again if it's reachable.
+func (c *FailoverConnector) checkPrimary(ctx context.Context) {
+	if c.active.Load() == 0 {
+		return
+	}
+
+	conn, err := c.connectors[0].Connect(ctx)
+	if err != nil {
+		log.Debugf("The primary database at %s is still unreachable: %s", c.name(0), err)
+		return
+	}
+	conn.Close()
+
+	c.active.Store(0)
+	log.Infof("The primary database at %s is reachable again; switching back to it", c.name(0))
+}
+
+// WatchPrimary checks whether the primary database has recovered every interval
+// while another database is active, until the context is done.
+func (c *FailoverConnector) WatchPrimary(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.checkPrimary(ctx)
+		}
+	}
+}
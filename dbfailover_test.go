@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type fakeConnector struct {
+	err error
+}
+
+func (f *fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return fakeConn{}, nil
+}
+
+func (f *fakeConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+type fakeConn struct {
+	driver.Conn
+}
+
+func (fakeConn) Close() error {
+	return nil
+}
+
+func TestFailoverConnector(t *testing.T) {
+	primary := &fakeConnector{err: errors.New("connection refused")}
+	c := &FailoverConnector{connectors: []driver.Connector{primary, &fakeConnector{}}}
+
+	before := testutil.ToFloat64(dbFailovers)
+
+	if _, err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("error calling Connect(): %s", err)
+	}
+	if active := c.active.Load(); active != 1 {
+		t.Errorf("database %d is active instead of database 1", active)
+	}
+	if actual := testutil.ToFloat64(dbFailovers) - before; actual != 1 {
+		t.Errorf("db_failover_total increased by %f instead of 1", actual)
+	}
+
+	c.checkPrimary(context.Background())
+	if active := c.active.Load(); active != 1 {
+		t.Errorf("switched back to the primary database while it was down")
+	}
+
+	primary.err = nil
+	c.checkPrimary(context.Background())
+	if active := c.active.Load(); active != 0 {
+		t.Errorf("database %d is active instead of the recovered primary", active)
+	}
+}
+
+func TestFailoverConnectorAllDown(t *testing.T) {
+	c := &FailoverConnector{connectors: []driver.Connector{
+		&fakeConnector{err: errors.New("connection refused")},
+		&fakeConnector{err: errors.New("no route to host")},
+	}}
+
+	if _, err := c.Connect(context.Background()); err == nil {
+		t.Error("expected an error when every database is down")
+	}
+	if active := c.active.Load(); active != 0 {
+		t.Errorf("database %d is active instead of the primary", active)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TxBeginner is implemented by *sql.DB and TracedDB.
+type TxBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// TracedDB wraps a *sql.DB with OTEL spans around the calls that acquire a
+// connection from the pool, so that time spent waiting for a connection shows
+// up in traces.
+type TracedDB struct {
+	*sql.DB
+}
+
+// waitSpan starts a span covering a call that has to acquire a connection.
+func waitSpan(ctx context.Context, name string) trace.Span {
+	_, span := otel.Tracer(otelName).Start(ctx, name, trace.WithAttributes(attribute.String("db.state", "waiting")))
+	return span
+}
+
+// BeginTx starts a transaction. The span ends once a connection has been
+// acquired and the transaction has started.
+func (t *TracedDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	span := waitSpan(ctx, "db.BeginTx")
+	defer span.End()
+
+	tx, err := t.DB.BeginTx(ctx, opts)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return tx, err
+}
+
+// QueryContext runs a query. The span ends once a connection has been acquired
+// and the query has returned its first results.
+func (t *TracedDB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	span := waitSpan(ctx, "db.QueryContext")
+	defer span.End()
+
+	rows, err := t.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return rows, err
+}
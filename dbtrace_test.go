@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracedDB(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(prev)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock database: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectCommit()
+	mock.ExpectQuery("select 1").WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+
+	traced := &TracedDB{db}
+	if err = InTx(context.Background(), traced, Timeouts{}, func(*sql.Tx) error { return nil }); err != nil {
+		t.Errorf("error calling InTx(): %s", err)
+	}
+	rows, err := traced.QueryContext(context.Background(), "select 1")
+	if err != nil {
+		t.Fatalf("error calling QueryContext(): %s", err)
+	}
+	rows.Close()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("%d spans were recorded instead of 2", len(spans))
+	}
+	for i, name := range []string{"db.BeginTx", "db.QueryContext"} {
+		if spans[i].Name() != name {
+			t.Errorf("span %d was named %s instead of %s", i, spans[i].Name(), name)
+		}
+		attrs := spans[i].Attributes()
+		if len(attrs) != 1 || attrs[0].Value.AsString() != "waiting" {
+			t.Errorf("unexpected attributes for span %s: %v", name, attrs)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// DeadLetter is a job that failed to propagate after all of its attempts were
+// used up.
+type DeadLetter struct {
+	ExternalID       string    `json:"external_id"`
+	FailedOn         time.Time `json:"failed_at"`
+	ErrorMessage     string    `json:"error_message"`
+	OriginalAttempts int64     `json:"original_attempts"`
+}
+
+// MarkDeadLetter records that the job with the given external ID permanently
+// failed to propagate, along with the reason and the number of attempts that
+// were made. Once the problem is fixed, the job can be re-enqueued by setting
+// propagation_attempts back to zero for its unpropagated status updates.
+func MarkDeadLetter(ctx context.Context, db DBTX, externalID string, reason string) error {
+	queryStr := `
+	insert into job_propagation_dead_letters (external_id, failed_at, error_message, original_attempts)
+	select $1, now(), $2, coalesce(max(propagation_attempts), 0)
+	  from job_status_updates
+	 where external_id = $1`
+	_, err := db.ExecContext(ctx, queryStr, externalID, reason)
+	return err
+}
+
+// RecentDeadLetters returns up to limit dead letters, most recent first.
+func RecentDeadLetters(ctx context.Context, d DBTX, limit int) ([]DeadLetter, error) {
+	queryStr := `
+	select external_id, failed_at, error_message, original_attempts
+	  from job_propagation_dead_letters
+	 order by failed_at desc
+	 limit $1`
+	rows, err := d.QueryContext(ctx, queryStr, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	retval := []DeadLetter{}
+	for rows.Next() {
+		var dl DeadLetter
+		if err = rows.Scan(&dl.ExternalID, &dl.FailedOn, &dl.ErrorMessage, &dl.OriginalAttempts); err != nil {
+			return nil, err
+		}
+		retval = append(retval, dl)
+	}
+	return retval, rows.Err()
+}
+
+// maxDeadLettersLimit is the largest limit accepted by DeadLettersHandler.
+const maxDeadLettersLimit = 1000
+
+// DeadLettersHandler lists the most recent dead letters as JSON. The number
+// returned defaults to 100 and can be changed with the limit query parameter,
+// up to 1000.
+func DeadLettersHandler(d *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, ok := queryInt(r, "limit", 100)
+		if !ok || limit > maxDeadLettersLimit {
+			http.Error(w, "limit must be an integer between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+
+		deadLetters, err := RecentDeadLetters(r.Context(), d, limit)
+		if err != nil {
+			log.Errorf("Error listing dead letters: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(deadLetters); err != nil {
+			log.Errorf("Error writing the dead letters response: %s", err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestMarkDeadLetter(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock database: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("insert into job_propagation_dead_letters").
+		WithArgs("job-1", "bad response").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err = MarkDeadLetter(context.Background(), db, "job-1", "bad response"); err != nil {
+		t.Errorf("error calling MarkDeadLetter(): %s", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeadLettersHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock database: %s", err)
+	}
+	defer db.Close()
+
+	failedOn := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("select external_id, failed_at, error_message, original_attempts").
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"external_id", "failed_at", "error_message", "original_attempts"}).
+			AddRow("job-1", failedOn, "bad response", 3))
+
+	w := httptest.NewRecorder()
+	DeadLettersHandler(db)(w, httptest.NewRequest(http.MethodGet, "/admin/dead-letters?limit=5", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d", w.Code, http.StatusOK)
+	}
+
+	var deadLetters []DeadLetter
+	if err = json.Unmarshal(w.Body.Bytes(), &deadLetters); err != nil {
+		t.Fatalf("error parsing the response body: %s", err)
+	}
+	if len(deadLetters) != 1 || deadLetters[0].ExternalID != "job-1" || deadLetters[0].OriginalAttempts != 3 {
+		t.Errorf("unexpected dead letters: %#v", deadLetters)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	for _, query := range []string{"limit=abc", "limit=0", "limit=1001"} {
+		w = httptest.NewRecorder()
+		DeadLettersHandler(db)(w, httptest.NewRequest(http.MethodGet, "/admin/dead-letters?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("status code for %s was %d instead of %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
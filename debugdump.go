@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// PropagationStats counts the outcomes of propagation attempts since the
+// service started. It's safe for concurrent use.
+type PropagationStats struct {
+	Succeeded atomic.Int64
+	Failed    atomic.Int64
+	Deferred  atomic.Int64
+}
+
+// propagationStatsSnapshot is the JSON representation of PropagationStats.
+type propagationStatsSnapshot struct {
+	Succeeded int64 `json:"succeeded"`
+	Failed    int64 `json:"failed"`
+	Deferred  int64 `json:"deferred"`
+}
+
+func (s *PropagationStats) snapshot() propagationStatsSnapshot {
+	return propagationStatsSnapshot{
+		Succeeded: s.Succeeded.Load(),
+		Failed:    s.Failed.Load(),
+		Deferred:  s.Deferred.Load(),
+	}
+}
+
+// debugDump is the content of the file written by a DebugDumper.
+type debugDump struct {
+	Timestamp    time.Time                `json:"timestamp"`
+	CurrentBatch []string                 `json:"current_batch"`
+	PendingJobs  []string                 `json:"pending_jobs"`
+	RetryCounts  map[string]int64         `json:"retry_counts"`
+	Stats        propagationStatsSnapshot `json:"propagation_stats"`
+	MemStats     runtime.MemStats         `json:"mem_stats"`
+}
+
+// DebugDumper keeps track of what the propagation loop is doing and writes it
+// to a JSON file on request.
+type DebugDumper struct {
+	path  string
+	stats *PropagationStats
+
+	mu           sync.Mutex
+	currentBatch []string
+	pendingJobs  []string
+	retryCounts  map[string]int64
+}
+
+// NewDebugDumper returns a *DebugDumper that writes to the file at path.
+func NewDebugDumper(path string, stats *PropagationStats) *DebugDumper {
+	return &DebugDumper{path: path, stats: stats}
+}
+
+// SetPending records the jobs returned by the last call to Unpropagated along
+// with the number of attempts already made for the ones being retried.
+func (d *DebugDumper) SetPending(pending []string, retryCounts map[string]int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pendingJobs = pending
+	d.retryCounts = retryCounts
+}
+
+// SetBatch records the batch of jobs currently being propagated.
+func (d *DebugDumper) SetBatch(batch []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.currentBatch = batch
+}
+
+// Dump writes the current state to the dumper's file.
+func (d *DebugDumper) Dump() error {
+	dump := debugDump{Timestamp: time.Now()}
+
+	d.mu.Lock()
+	dump.CurrentBatch = d.currentBatch
+	dump.PendingJobs = d.pendingJobs
+	dump.RetryCounts = d.retryCounts
+	d.mu.Unlock()
+
+	dump.Stats = d.stats.snapshot()
+	runtime.ReadMemStats(&dump.MemStats)
+
+	b, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(d.path, b, 0644)
+}
+
+// DumpOnSignal writes the current state to the dumper's file each time the
+// process receives SIGUSR1, until the context is cancelled.
+func (d *DebugDumper) DumpOnSignal(ctx context.Context) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	defer signal.Stop(sigs)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+			if err := d.Dump(); err != nil {
+				log.Errorf("Error writing the debug dump to %s: %s", d.path, err)
+			} else {
+				log.Infof("Wrote the debug dump to %s", d.path)
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDebugDumperDump(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.json")
+	stats := &PropagationStats{}
+	stats.Succeeded.Add(2)
+	stats.Failed.Add(1)
+
+	d := NewDebugDumper(path, stats)
+	d.SetPending([]string{"1", "2", "3"}, map[string]int64{"2": 1})
+	d.SetBatch([]string{"1", "2"})
+
+	if err := d.Dump(); err != nil {
+		t.Fatalf("error calling Dump(): %s", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading the dump: %s", err)
+	}
+
+	var dump debugDump
+	if err = json.Unmarshal(b, &dump); err != nil {
+		t.Fatalf("error parsing the dump: %s", err)
+	}
+
+	if len(dump.PendingJobs) != 3 || len(dump.CurrentBatch) != 2 {
+		t.Errorf("unexpected jobs in the dump: %s", string(b))
+	}
+
+	if len(dump.RetryCounts) != 1 || dump.RetryCounts["2"] != 1 {
+		t.Errorf("unexpected retry counts: %v", dump.RetryCounts)
+	}
+
+	if dump.Stats.Succeeded != 2 || dump.Stats.Failed != 1 {
+		t.Errorf("unexpected stats: %+v", dump.Stats)
+	}
+
+	if dump.MemStats.HeapAlloc == 0 {
+		t.Error("memory stats were not included in the dump")
+	}
+}
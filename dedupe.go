@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// processedStatus is the response body of the apps service's job status
+// endpoint.
+type processedStatus struct {
+	Processed bool `json:"processed"`
+}
+
+// statusURI returns the URI of the apps service endpoint that reports whether
+// one of the job's status updates was already processed, i.e.
+// {appsURI}/{uuid}/status?update_id={updateID}.
+func (p *Propagator) statusURI(uuid, updateID string) string {
+	return fmt.Sprintf("%s/%s/status?update_id=%s", strings.TrimSuffix(p.appsURI, "/"), uuid, url.QueryEscape(updateID))
+}
+
+// AlreadyProcessed asks the apps service whether it has already processed the
+// job's status update with the given ID. The check is made for each update
+// rather than for the job, so that the updates sent after the first one
+// aren't mistaken for ones the service has already seen. A 404 response means
+// it hasn't processed the update. Otherwise the response must be a JSON
+// object with a boolean "processed" field.
+func (p *Propagator) AlreadyProcessed(ctx context.Context, uuid, updateID string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.statusURI(uuid, updateID), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, maskURLError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("status request for update %s of job %s returned %s", updateID, uuid, resp.Status)
+	}
+
+	var status processedStatus
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxErrorBody)).Decode(&status); err != nil {
+		return false, fmt.Errorf("unable to parse the status of update %s of job %s: %w", updateID, uuid, err)
+	}
+	return status.Processed, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPropagateDeduplication(t *testing.T) {
+	tests := []struct {
+		name   string
+		status func(w http.ResponseWriter)
+		posted bool
+	}{
+		{"processed", func(w http.ResponseWriter) { fmt.Fprint(w, `{"processed": true}`) }, false},
+		{"not processed", func(w http.ResponseWriter) { fmt.Fprint(w, `{"processed": false}`) }, true},
+		{"unknown job", func(w http.ResponseWriter) { http.NotFound(w, nil) }, true},
+		{"status unavailable", func(w http.ResponseWriter) { http.Error(w, "down", http.StatusInternalServerError) }, true},
+	}
+
+	for _, test := range tests {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error occurred creating the mock db: %s", err)
+		}
+
+		var posted bool
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodGet && r.URL.Path == "/callbacks/external-id/status" && r.URL.Query().Get("update_id") == "update-1":
+				test.status(w)
+			case r.Method == http.MethodPost && r.URL.Path == "/callbacks":
+				posted = true
+			default:
+				t.Errorf("%s: unexpected request: %s %s", test.name, r.Method, r.URL.Path)
+			}
+		}))
+
+		expectUpdates(mock, "external-id", "update-1")
+		expectMarked(mock, "update-1")
+
+		p, err := NewPropagator(db, server.URL+"/callbacks", &PropagatorOptions{Deduplicate: true})
+		if err != nil {
+			t.Fatalf("error calling NewPropagator(): %s", err)
+		}
+
+		if err = p.Propagate(context.Background(), "external-id"); err != nil {
+			t.Errorf("%s: error from Propagate(): %s", test.name, err)
+		}
+		if posted != test.posted {
+			t.Errorf("%s: posted was %t instead of %t", test.name, posted, test.posted)
+		}
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: the job wasn't marked as propagated: %s", test.name, err)
+		}
+
+		server.Close()
+		db.Close()
+	}
+}
+
+func TestPropagateDeduplicationPerUpdate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	// The service has processed the first update but not the second, which
+	// has to be sent even though the job is known to the service.
+	var posted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			fmt.Fprintf(w, `{"processed": %t}`, r.URL.Query().Get("update_id") == "update-1")
+		case http.MethodPost:
+			var jsu JobStatusUpdate
+			if err := json.NewDecoder(r.Body).Decode(&jsu); err != nil {
+				t.Error(err)
+			}
+			posted = append(posted, jsu.ID)
+		}
+	}))
+	defer server.Close()
+
+	expectUpdates(mock, "external-id", "update-1", "update-2")
+	expectMarked(mock, "update-1")
+	expectMarked(mock, "update-2")
+
+	p, err := NewPropagator(db, server.URL+"/callbacks", &PropagatorOptions{Deduplicate: true})
+	if err != nil {
+		t.Fatalf("error calling NewPropagator(): %s", err)
+	}
+	if err = p.Propagate(context.Background(), "external-id"); err != nil {
+		t.Errorf("error from Propagate(): %s", err)
+	}
+
+	if len(posted) != 1 || posted[0] != "update-2" {
+		t.Errorf("posted %v instead of [update-2]", posted)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
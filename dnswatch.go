@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// DNSWatcher re-resolves the hosts of the apps URIs so that changes to their
+// addresses can be noticed, e.g. in service discovery environments where the
+// addresses change more often than the system's DNS TTL suggests.
+type DNSWatcher struct {
+	hosts  []string
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+	last   map[string]string
+}
+
+// NewDNSWatcher returns a *DNSWatcher for the hosts of the URIs. Hosts that are
+// IP addresses are skipped since they never change.
+func NewDNSWatcher(uris []string) (*DNSWatcher, error) {
+	w := &DNSWatcher{
+		lookup: net.DefaultResolver.LookupIPAddr,
+		last:   map[string]string{},
+	}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return nil, err
+		}
+		host := u.Hostname()
+		if host == "" || net.ParseIP(host) != nil || slices.Contains(w.hosts, host) {
+			continue
+		}
+		w.hosts = append(w.hosts, host)
+	}
+	return w, nil
+}
+
+// Changed resolves each of the hosts and returns true if any of them resolved
+// to different addresses than the last time it was called. The first call
+// only records the addresses. Hosts that can't be resolved are logged and
+// skipped.
+func (w *DNSWatcher) Changed(ctx context.Context) bool {
+	var changed bool
+	for _, host := range w.hosts {
+		addrs, err := w.lookup(ctx, host)
+		if err != nil {
+			log.Warnf("Unable to resolve the apps service host %s: %s", host, err)
+			continue
+		}
+
+		ips := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			ips = append(ips, addr.String())
+		}
+		slices.Sort(ips)
+		current := strings.Join(ips, ",")
+
+		if last, ok := w.last[host]; ok && last != current {
+			log.Warnf("The apps service host %s now resolves to %s instead of %s", host, current, last)
+			changed = true
+		}
+		w.last[host] = current
+	}
+	return changed
+}
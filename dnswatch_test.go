@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestNewDNSWatcher(t *testing.T) {
+	w, err := NewDNSWatcher([]string{
+		"http://apps/callbacks",
+		"http://apps:8080/callbacks",
+		"http://10.0.0.1/callbacks",
+		"https://shadow.example.org/callbacks",
+	})
+	if err != nil {
+		t.Fatalf("NewDNSWatcher returned an error: %s", err)
+	}
+
+	expected := []string{"apps", "shadow.example.org"}
+	if !reflect.DeepEqual(w.hosts, expected) {
+		t.Errorf("the hosts were %v instead of %v", w.hosts, expected)
+	}
+}
+
+func TestDNSWatcherChanged(t *testing.T) {
+	results := [][]string{
+		{"10.0.0.2", "10.0.0.1"},
+		{"10.0.0.1", "10.0.0.2"},
+		nil,
+		{"10.0.0.3"},
+	}
+	var calls int
+	w := &DNSWatcher{
+		hosts: []string{"apps"},
+		last:  map[string]string{},
+		lookup: func(context.Context, string) ([]net.IPAddr, error) {
+			result := results[calls]
+			calls++
+			if result == nil {
+				return nil, errors.New("no such host")
+			}
+			var addrs []net.IPAddr
+			for _, ip := range result {
+				addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+			}
+			return addrs, nil
+		},
+	}
+
+	for i, expected := range []bool{false, false, false, true} {
+		if actual := w.Changed(context.Background()); actual != expected {
+			t.Errorf("call %d to Changed returned %t instead of %t", i+1, actual, expected)
+		}
+	}
+}
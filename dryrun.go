@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// DryRunPropagator looks up the status updates that would be propagated and
+// logs the requests that would be sent for them, without sending anything to
+// the apps service or marking the updates as propagated.
+type DryRunPropagator struct {
+	db      *sql.DB
+	method  string
+	logURIs []string
+
+	jobs atomic.Int64
+}
+
+// NewDryRunPropagator returns a *DryRunPropagator for the apps URIs that
+// updates would be sent to with the given method.
+func NewDryRunPropagator(d *sql.DB, method string, appsURIs []string) *DryRunPropagator {
+	if method == "" {
+		method = http.MethodPost
+	}
+	p := &DryRunPropagator{db: d, method: method}
+	for _, uri := range appsURIs {
+		p.logURIs = append(p.logURIs, MaskAppsURI(uri))
+	}
+	return p
+}
+
+// Propagate logs the requests that would be sent for the job's unpropagated
+// status updates.
+func (p *DryRunPropagator) Propagate(ctx context.Context, uuid string) error {
+	log := loggerFromContext(ctx)
+
+	updates, err := UnpropagatedUpdates(ctx, p.db, uuid)
+	if err != nil {
+		return pkgerrors.WithStack(err)
+	}
+	for _, jsu := range updates {
+		msg, err := json.Marshal(jsu)
+		if err != nil {
+			return pkgerrors.WithStack(err)
+		}
+		for _, uri := range p.logURIs {
+			log.Infof("Dry run: would send %s %s with %s", p.method, uri, msg)
+		}
+	}
+	if len(updates) > 0 {
+		p.jobs.Add(1)
+	}
+	return nil
+}
+
+// Reset returns the number of jobs that would have been propagated since the
+// last call.
+func (p *DryRunPropagator) Reset() int64 {
+	return p.jobs.Swap(0)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestDryRunPropagator(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	hook := logtest.NewLocal(log.Logger)
+	defer log.Logger.ReplaceHooks(make(logrus.LevelHooks))
+
+	p := NewDryRunPropagator(db, "", []string{"http://apps/callbacks?token=s3cret"})
+
+	// Nothing is marked as propagated.
+	expectUpdates(mock, "job-1", "update-1", "update-2")
+	expectUpdates(mock, "job-2")
+	if err = p.Propagate(context.Background(), "job-1"); err != nil {
+		t.Errorf("error from Propagate(): %s", err)
+	}
+	if err = p.Propagate(context.Background(), "job-2"); err != nil {
+		t.Errorf("error from Propagate(): %s", err)
+	}
+
+	entries := hook.AllEntries()
+	if len(entries) != 2 {
+		t.Fatalf("%d entries were logged instead of 2", len(entries))
+	}
+	for _, expected := range []string{"POST", `"id":"update-1"`, "token=***"} {
+		if !strings.Contains(entries[0].Message, expected) {
+			t.Errorf("%q doesn't contain %q", entries[0].Message, expected)
+		}
+	}
+
+	if actual := p.Reset(); actual != 1 {
+		t.Errorf("Reset returned %d instead of 1", actual)
+	}
+	if actual := p.Reset(); actual != 0 {
+		t.Errorf("Reset returned %d instead of 0 after a reset", actual)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleDryRun(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	stats := &PropagationStats{}
+	h := &jobHandler{
+		db:          db,
+		maxRetries:  1,
+		propagator:  NewDryRunPropagator(db, "", []string{"http://apps/callbacks"}),
+		stats:       stats,
+		deadLetters: true,
+		dryRun:      true,
+	}
+
+	// Neither a successful lookup nor a failed one writes anything, even
+	// when the failure uses up the job's last attempt.
+	expectUpdates(mock, "job-1", "update-1")
+	mock.ExpectQuery("select id, status, sent_on").
+		WithArgs("job-2").
+		WillReturnError(errors.New("connection refused"))
+	mock.ExpectExec(".")
+
+	h.handle(context.Background(), "job-1", 0, NewRetryBudget(0))
+	h.handle(context.Background(), "job-2", 0, NewRetryBudget(0))
+
+	if stats.Succeeded.Load() != 1 || stats.Failed.Load() != 1 {
+		t.Errorf("unexpected stats: %+v", stats.snapshot())
+	}
+	if err = mock.ExpectationsWereMet(); err == nil {
+		t.Error("a statement was run during a dry run")
+	} else if !strings.Contains(err.Error(), "ExpectedExec") {
+		t.Error(err)
+	}
+}
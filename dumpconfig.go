@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// sensitiveKeys are the substrings of setting names whose values are redacted
+// by RedactSettings.
+var sensitiveKeys = []string{"password", "token", "secret", "key"}
+
+// RedactSettings returns a copy of the settings with the values of sensitive
+// settings replaced by ***. Passwords embedded in URIs and DSNs are masked as
+// well.
+func RedactSettings(settings map[string]any) map[string]any {
+	redacted := make(map[string]any, len(settings))
+	for name, value := range settings {
+		redacted[name] = redactSetting(name, value)
+	}
+	return redacted
+}
+
+func redactSetting(name string, value any) any {
+	if nested, ok := value.(map[string]any); ok {
+		return RedactSettings(nested)
+	}
+
+	lower := strings.ToLower(name)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(lower, s) {
+			return "***"
+		}
+	}
+
+	if str, ok := value.(string); ok {
+		return MaskDBURI(str)
+	}
+	return value
+}
+
+// DumpConfig writes the settings to w as YAML with sensitive values redacted.
+func DumpConfig(w io.Writer, settings map[string]any) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(RedactSettings(settings)); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// minErrorBudgetSamples is the number of propagation results that must be in
+// the window before the error rate is checked, so that a single early failure
+// doesn't pause propagation.
+const minErrorBudgetSamples = 10
+
+// ErrorBudget tracks the propagation error rate over a rolling window and
+// pauses propagation for a while when it exceeds a threshold.
+type ErrorBudget struct {
+	threshold float64
+	window    time.Duration
+	pause     time.Duration
+	now       func() time.Time
+
+	mu          sync.Mutex
+	results     []errorBudgetResult
+	pausedUntil time.Time
+}
+
+type errorBudgetResult struct {
+	at     time.Time
+	failed bool
+}
+
+// NewErrorBudget returns an ErrorBudget that pauses propagation for pause when
+// more than threshold (0.0-1.0) of the propagations in the last window failed.
+func NewErrorBudget(threshold float64, window, pause time.Duration) *ErrorBudget {
+	return &ErrorBudget{
+		threshold: threshold,
+		window:    window,
+		pause:     pause,
+		now:       time.Now,
+	}
+}
+
+// Record adds the result of a propagation to the window and starts a pause if
+// the error rate is now above the threshold.
+func (b *ErrorBudget) Record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.results = append(b.results, errorBudgetResult{at: now, failed: failed})
+
+	cutoff := now.Add(-b.window)
+	i := 0
+	for i < len(b.results) && b.results[i].at.Before(cutoff) {
+		i++
+	}
+	b.results = b.results[i:]
+
+	if len(b.results) < minErrorBudgetSamples || now.Before(b.pausedUntil) {
+		return
+	}
+
+	var failures int
+	for _, r := range b.results {
+		if r.failed {
+			failures++
+		}
+	}
+
+	rate := float64(failures) / float64(len(b.results))
+	if rate > b.threshold {
+		log.Warnf("%.0f%% of the last %d propagations failed; pausing propagation for %s", rate*100, len(b.results), b.pause)
+		b.pausedUntil = now.Add(b.pause)
+		b.results = nil
+		errorBudgetExhausted.Inc()
+	}
+}
+
+// Paused returns true if propagation is currently paused.
+func (b *ErrorBudget) Paused() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.now().Before(b.pausedUntil)
+}
+
+// Wait blocks until propagation isn't paused or the context is done, in which
+// case it returns the context's error.
+func (b *ErrorBudget) Wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		remaining := b.pausedUntil.Sub(b.now())
+		b.mu.Unlock()
+
+		if remaining <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(remaining)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
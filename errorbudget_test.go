@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestErrorBudget(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	b := NewErrorBudget(0.5, 5*time.Minute, 30*time.Second)
+	b.now = func() time.Time { return now }
+
+	before := testutil.ToFloat64(errorBudgetExhausted)
+
+	// Old failures fall out of the window.
+	for i := 0; i < minErrorBudgetSamples; i++ {
+		b.Record(i%2 == 0)
+	}
+	now = now.Add(6 * time.Minute)
+
+	for i := 0; i < minErrorBudgetSamples-1; i++ {
+		b.Record(true)
+	}
+	if b.Paused() {
+		t.Fatal("paused before there were enough results in the window")
+	}
+
+	b.Record(false)
+	if !b.Paused() {
+		t.Fatal("not paused after the error rate exceeded the threshold")
+	}
+	if actual := testutil.ToFloat64(errorBudgetExhausted) - before; actual != 1 {
+		t.Errorf("error_budget_exhausted_total increased by %f instead of 1", actual)
+	}
+
+	now = now.Add(31 * time.Second)
+	if b.Paused() {
+		t.Error("still paused after the pause duration")
+	}
+}
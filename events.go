@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+)
+
+// EventType is the kind of state change recorded by an EventStore.
+type EventType string
+
+const (
+	// EventPropagationAttempted is recorded before each attempt to propagate a
+	// job's status updates.
+	EventPropagationAttempted EventType = "PropagationAttempted"
+
+	// EventPropagationSucceeded is recorded when an attempt succeeds.
+	EventPropagationSucceeded EventType = "PropagationSucceeded"
+
+	// EventPropagationFailed is recorded when an attempt fails.
+	EventPropagationFailed EventType = "PropagationFailed"
+
+	// EventMaxRetriesReached is recorded when a job won't be attempted again.
+	EventMaxRetriesReached EventType = "MaxRetriesReached"
+)
+
+// EventStore appends an immutable event to the job_propagation_events table for
+// each state change, as an audit trail for downstream event processors. A nil
+// *EventStore doesn't record anything.
+type EventStore struct {
+	db *sql.DB
+}
+
+// NewEventStore returns an *EventStore that records events in d.
+func NewEventStore(d *sql.DB) *EventStore {
+	return &EventStore{db: d}
+}
+
+// Record appends an event of the given type for the job. The payload is stored
+// as JSON.
+func (s *EventStore) Record(ctx context.Context, externalID string, eventType EventType, payload any) error {
+	if s == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	queryStr := `
+	insert into job_propagation_events (external_id, event_type, payload, occurred_at)
+	values ($1, $2, $3, now())`
+	_, err = s.db.ExecContext(ctx, queryStr, externalID, string(eventType), string(b))
+	return err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectEvent expects an event of the given type to be recorded for the job.
+func expectEvent(mock sqlmock.Sqlmock, externalID string, eventType EventType) {
+	mock.ExpectExec("insert into job_propagation_events").
+		WithArgs(externalID, string(eventType), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestEventStoreRecord(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock database: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("insert into job_propagation_events \\(external_id, event_type, payload, occurred_at\\)").
+		WithArgs("job-1", "PropagationFailed", `{"attempt":2,"error":"bad response"}`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	s := NewEventStore(db)
+	err = s.Record(context.Background(), "job-1", EventPropagationFailed, map[string]any{"attempt": 2, "error": "bad response"})
+	if err != nil {
+		t.Errorf("Record returned an error: %s", err)
+	}
+
+	var nilStore *EventStore
+	if err = nilStore.Record(context.Background(), "job-1", EventPropagationFailed, nil); err != nil {
+		t.Errorf("Record on a nil *EventStore returned an error: %s", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleRecordsEvents(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock database: %s", err)
+	}
+	defer db.Close()
+
+	stub := &stubPropagator{}
+	h := &jobHandler{db: db, maxRetries: 3, propagator: stub, stats: &PropagationStats{}, events: NewEventStore(db)}
+
+	expectEvent(mock, "job-1", EventPropagationAttempted)
+	expectEvent(mock, "job-1", EventPropagationSucceeded)
+	h.handle(context.Background(), "job-1", 0, NewRetryBudget(0))
+
+	stub.err = errors.New("the apps service is down")
+	expectEvent(mock, "job-2", EventPropagationAttempted)
+	mock.ExpectExec("set propagation_attempts = propagation_attempts \\+ 1").
+		WithArgs("job-2", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectEvent(mock, "job-2", EventPropagationFailed)
+	expectEvent(mock, "job-2", EventMaxRetriesReached)
+	h.handle(context.Background(), "job-2", 2, NewRetryBudget(1))
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
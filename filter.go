@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+)
+
+// JobDetails contains the fields of a job that a --jobs-filter-expr expression
+// can refer to.
+type JobDetails struct {
+	UUID    string
+	Status  string
+	AppID   string
+	JobType string
+}
+
+// celValue returns the value of the job variable seen by filter expressions.
+func (j *JobDetails) celValue() map[string]any {
+	return map[string]any{
+		"uuid":     j.UUID,
+		"status":   j.Status,
+		"app_id":   j.AppID,
+		"job_type": j.JobType,
+	}
+}
+
+// LookupJobDetails returns the details of the job with the given external ID.
+// The status is taken from the job's most recent status update.
+func LookupJobDetails(ctx context.Context, d DBTX, externalID string) (*JobDetails, error) {
+	job := &JobDetails{UUID: externalID}
+	err := d.QueryRowContext(ctx, `
+	select u.status, coalesce(j.app_id, ''), coalesce(t.name, '')
+	  from job_status_updates u
+	  left join job_steps s on s.external_id = u.external_id
+	  left join jobs j on j.id = s.job_id
+	  left join job_types t on t.id = s.job_type_id
+	 where u.external_id = $1
+	 order by u.sent_on desc
+	 limit 1`, externalID).Scan(&job.Status, &job.AppID, &job.JobType)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// JobFilter decides whether a job's status updates should be propagated using a
+// CEL expression, e.g. job.status == 'Failed' && job.app_id != 'test-app'.
+type JobFilter struct {
+	expr    string
+	program cel.Program
+}
+
+// NewJobFilter compiles a CEL expression into a JobFilter. The expression
+// refers to the job as the map variable job and must evaluate to a bool.
+func NewJobFilter(expr string) (*JobFilter, error) {
+	env, err := cel.NewEnv(cel.Variable("job", cel.MapType(cel.StringType, cel.DynType)))
+	if err != nil {
+		return nil, err
+	}
+
+	ast, issues := env.Compile(expr)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("invalid filter expression %q: %w", expr, issues.Err())
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("filter expression %q returns %s instead of bool", expr, ast.OutputType())
+	}
+
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter expression %q: %w", expr, err)
+	}
+
+	return &JobFilter{expr: expr, program: program}, nil
+}
+
+// Match returns true if the job passes the filter.
+func (f *JobFilter) Match(job *JobDetails) (bool, error) {
+	out, _, err := f.program.Eval(map[string]any{"job": job.celValue()})
+	if err != nil {
+		return false, fmt.Errorf("error evaluating filter expression %q for job %s: %w", f.expr, job.UUID, err)
+	}
+
+	matched, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("filter expression %q returned %v instead of a bool for job %s", f.expr, out.Value(), job.UUID)
+	}
+	return matched, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestJobFilter(t *testing.T) {
+	filter, err := NewJobFilter("job.status == 'Failed' && job.app_id != 'test-app'")
+	if err != nil {
+		t.Fatalf("error calling NewJobFilter(): %s", err)
+	}
+
+	tests := []struct {
+		job      JobDetails
+		expected bool
+	}{
+		{JobDetails{UUID: "a", Status: "Failed", AppID: "word-count"}, true},
+		{JobDetails{UUID: "b", Status: "Failed", AppID: "test-app"}, false},
+		{JobDetails{UUID: "c", Status: "Running", AppID: "word-count"}, false},
+	}
+
+	for _, test := range tests {
+		actual, err := filter.Match(&test.job)
+		if err != nil {
+			t.Errorf("error calling Match() for job %s: %s", test.job.UUID, err)
+		}
+		if actual != test.expected {
+			t.Errorf("Match() returned %t for job %s instead of %t", actual, test.job.UUID, test.expected)
+		}
+	}
+}
+
+func TestNewJobFilterInvalid(t *testing.T) {
+	for _, expr := range []string{"job.status ==", "job.status"} {
+		if _, err := NewJobFilter(expr); err == nil {
+			t.Errorf("expected an error compiling %q", expr)
+		}
+	}
+}
+
+func TestLookupJobDetails(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock database: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("select u.status").
+		WithArgs("job-1").
+		WillReturnRows(sqlmock.NewRows([]string{"status", "app_id", "name"}).AddRow("Failed", "word-count", "DE"))
+
+	job, err := LookupJobDetails(context.Background(), db, "job-1")
+	if err != nil {
+		t.Fatalf("error calling LookupJobDetails(): %s", err)
+	}
+	if job.Status != "Failed" || job.AppID != "word-count" || job.JobType != "DE" {
+		t.Errorf("unexpected job details: %#v", job)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"runtime"
+	"time"
+)
+
+// GCTrigger forces a garbage collection after large propagation passes, for
+// memory-constrained environments where the runtime doesn't return memory
+// quickly enough on its own. A nil *GCTrigger never collects.
+type GCTrigger struct {
+	interval time.Duration
+	minJobs  int
+
+	last    time.Time
+	now     func() time.Time
+	collect func()
+}
+
+// NewGCTrigger returns a *GCTrigger that collects garbage after passes that
+// handled more than minJobs jobs, at most once per interval.
+func NewGCTrigger(interval time.Duration, minJobs int) *GCTrigger {
+	return &GCTrigger{
+		interval: interval,
+		minJobs:  minJobs,
+		now:      time.Now,
+		collect:  runtime.GC,
+	}
+}
+
+// AfterPass runs a garbage collection if the pass handled enough jobs and the
+// interval has passed since the last one. It returns true if it collected.
+func (g *GCTrigger) AfterPass(jobs int) bool {
+	if g == nil || jobs <= g.minJobs {
+		return false
+	}
+
+	now := g.now()
+	if !g.last.IsZero() && now.Sub(g.last) < g.interval {
+		return false
+	}
+
+	g.collect()
+	g.last = g.now()
+	log.Debugf("Collected garbage after a pass of %d jobs in %s", jobs, g.last.Sub(now))
+	return true
+}
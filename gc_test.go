@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGCTrigger(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var collections int
+	g := NewGCTrigger(time.Minute, 100)
+	g.now = func() time.Time { return now }
+	g.collect = func() { collections++ }
+
+	steps := []struct {
+		elapsed  time.Duration
+		jobs     int
+		expected bool
+	}{
+		{0, 100, false},                // Not more than the trigger count.
+		{0, 101, true},                 // The first collection isn't delayed.
+		{30 * time.Second, 500, false}, // Too soon after the last one.
+		{30 * time.Second, 500, true},
+	}
+
+	for i, step := range steps {
+		now = now.Add(step.elapsed)
+		if actual := g.AfterPass(step.jobs); actual != step.expected {
+			t.Errorf("step %d: AfterPass returned %t instead of %t", i+1, actual, step.expected)
+		}
+	}
+	if collections != 2 {
+		t.Errorf("collected %d times instead of 2", collections)
+	}
+
+	var nilTrigger *GCTrigger
+	if nilTrigger.AfterPass(10000) {
+		t.Error("a nil *GCTrigger collected")
+	}
+}
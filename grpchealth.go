@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// grpcHealthCheckInterval is how often the database is checked when updating
+// the status reported by the gRPC health service.
+const grpcHealthCheckInterval = 10 * time.Second
+
+// CheckDB returns an error if the query fails, or if the database can't be
+// pinged when the query is empty. The query's results are discarded, so a
+// query that returns no rows still passes.
+func CheckDB(ctx context.Context, d *sql.DB, query string) error {
+	if query == "" {
+		return d.PingContext(ctx)
+	}
+	rows, err := d.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	rows.Close()
+	return rows.Err()
+}
+
+// updateHealth sets the serving status of the overall server and of this
+// service based on whether or not the database passes CheckDB.
+func updateHealth(ctx context.Context, hs *health.Server, d *sql.DB, query string) {
+	status := healthpb.HealthCheckResponse_SERVING
+	if err := CheckDB(ctx, d, query); err != nil {
+		log.Warnf("Database health check failed; reporting NOT_SERVING: %s", err)
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	hs.SetServingStatus("", status)
+	hs.SetServingStatus(serviceName, status)
+}
+
+// ServeGRPCHealth serves the standard gRPC health checking protocol on the
+// given port. It reports SERVING while the database passes CheckDB with the
+// given query and NOT_SERVING otherwise. It blocks until the context is done,
+// at which point the server stops gracefully.
+func ServeGRPCHealth(ctx context.Context, d *sql.DB, port int, query string) error {
+	sock, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", port))
+	if err != nil {
+		return err
+	}
+
+	hs := health.NewServer()
+	updateHealth(ctx, hs, d, query)
+
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, hs)
+
+	go func() {
+		ticker := time.NewTicker(grpcHealthCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				hs.Shutdown()
+				server.GracefulStop()
+				return
+			case <-ticker.C:
+				updateHealth(ctx, hs, d, query)
+			}
+		}
+	}()
+
+	return server.Serve(sock)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestUpdateHealth(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+
+	hs := health.NewServer()
+	req := &healthpb.HealthCheckRequest{Service: serviceName}
+
+	updateHealth(context.Background(), hs, db, "")
+	resp, err := hs.Check(context.Background(), req)
+	if err != nil {
+		t.Fatalf("error checking health: %s", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("status was %s instead of SERVING", resp.Status)
+	}
+
+	db.Close()
+
+	updateHealth(context.Background(), hs, db, "")
+	resp, err = hs.Check(context.Background(), req)
+	if err != nil {
+		t.Fatalf("error checking health: %s", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("status was %s instead of NOT_SERVING", resp.Status)
+	}
+}
+
+func TestCheckDB(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	query := "SELECT 1 FROM job_status_updates LIMIT 1"
+	mock.ExpectQuery("SELECT 1 FROM job_status_updates").WillReturnRows(sqlmock.NewRows([]string{"?column?"}))
+	if err = CheckDB(context.Background(), db, query); err != nil {
+		t.Errorf("CheckDB() returned an error for an empty table: %s", err)
+	}
+
+	missing := errors.New(`relation "job_status_updates" does not exist`)
+	mock.ExpectQuery("SELECT 1 FROM job_status_updates").WillReturnError(missing)
+	if err = CheckDB(context.Background(), db, query); !errors.Is(err, missing) {
+		t.Errorf("CheckDB() returned %v instead of %v", err, missing)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
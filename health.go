@@ -0,0 +1,35 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// HealthzHandler reports that the process is alive. It's meant for liveness
+// probes, so it doesn't check any dependencies.
+func HealthzHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// ReadyzHandler reports whether the service is ready. It returns 200 once
+// passed is true, meaning the propagation loop has finished at least one pass,
+// and only while the database passes CheckDB with the given query. It returns
+// 503 otherwise.
+func ReadyzHandler(d *sql.DB, query string, passed *atomic.Bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !passed.Load() {
+			http.Error(w, "the first propagation pass hasn't finished", http.StatusServiceUnavailable)
+			return
+		}
+		if err := CheckDB(r.Context(), d, query); err != nil {
+			log.Warnf("Readiness check failed: %s", err)
+			http.Error(w, "the database health check failed", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
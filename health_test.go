@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestHealthzHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	HealthzHandler()(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status was %d instead of 200", w.Code)
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	query := "SELECT 1 FROM job_status_updates LIMIT 1"
+	var passed atomic.Bool
+	handler := ReadyzHandler(db, query, &passed)
+
+	check := func(expected int) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if w.Code != expected {
+			t.Errorf("status was %d instead of %d", w.Code, expected)
+		}
+	}
+
+	// The database isn't checked until the first pass has finished.
+	check(http.StatusServiceUnavailable)
+
+	passed.Store(true)
+	mock.ExpectQuery("SELECT 1 FROM job_status_updates").WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+	check(http.StatusOK)
+
+	mock.ExpectQuery("SELECT 1 FROM job_status_updates").WillReturnError(errors.New("connection refused"))
+	check(http.StatusServiceUnavailable)
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
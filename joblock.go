@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+)
+
+// ErrJobLocked is returned by LockingPropagator when another instance of the
+// service is already propagating the job.
+var ErrJobLocked = errors.New("the job is being propagated by another instance")
+
+// LockingPropagator holds a Postgres advisory lock on a job's external ID
+// while another JobPropagator propagates it, so that replicas that pick up the
+// same job at the same time don't both propagate it. The lock is a session
+// lock held on a dedicated connection rather than a transaction lock, so no
+// transaction stays open while the apps service is called, but each
+// propagation still uses a second database connection.
+type LockingPropagator struct {
+	db         *sql.DB
+	propagator JobPropagator
+}
+
+// NewLockingPropagator returns a *LockingPropagator that uses p to propagate
+// the jobs it locks.
+func NewLockingPropagator(d *sql.DB, p JobPropagator) *LockingPropagator {
+	return &LockingPropagator{db: d, propagator: p}
+}
+
+// Propagate locks the job and propagates it. It returns ErrJobLocked without
+// propagating anything if another instance holds the lock. Failing to release
+// the lock is returned as an error even if the propagation succeeded.
+func (l *LockingPropagator) Propagate(ctx context.Context, uuid string) error {
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err = conn.QueryRowContext(ctx, "select pg_try_advisory_lock(hashtext($1))", uuid).Scan(&locked); err != nil {
+		return err
+	}
+	if !locked {
+		return ErrJobLocked
+	}
+
+	err = l.propagator.Propagate(ctx, uuid)
+
+	// The lock is released even if ctx was cancelled during the propagation.
+	var unlocked bool
+	unlockErr := conn.QueryRowContext(context.WithoutCancel(ctx), "select pg_advisory_unlock(hashtext($1))", uuid).Scan(&unlocked)
+	if unlockErr == nil && !unlocked {
+		unlockErr = errors.New("the lock wasn't held")
+	}
+	if unlockErr != nil {
+		// The session may still hold the lock, so the connection is closed
+		// instead of being returned to the pool.
+		conn.Raw(func(any) error { return driver.ErrBadConn }) //nolint:errcheck
+		return errors.Join(err, fmt.Errorf("unable to release the lock on job %s: %w", uuid, unlockErr))
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+// countingPropagator counts the calls to Propagate and returns err from each.
+type countingPropagator struct {
+	calls int
+	err   error
+}
+
+func (c *countingPropagator) Propagate(ctx context.Context, uuid string) error {
+	c.calls++
+	return c.err
+}
+
+func TestLockingPropagator(t *testing.T) {
+	propagateErr := errors.New("the apps service is down")
+
+	unlockErr := errors.New("connection reset")
+
+	tests := []struct {
+		name      string
+		locked    bool
+		inner     error
+		unlockErr error
+		expected  error
+		propCalls int
+	}{
+		{"acquired", true, nil, nil, nil, 1},
+		{"inner error", true, propagateErr, nil, propagateErr, 1},
+		{"held elsewhere", false, nil, nil, ErrJobLocked, 0},
+		{"unlock error", true, nil, unlockErr, unlockErr, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error occurred creating the mock db: %s", err)
+			}
+			defer db.Close()
+
+			mock.ExpectQuery("select pg_try_advisory_lock\\(hashtext\\(\\$1\\)\\)").
+				WithArgs("job-1").
+				WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_lock"}).AddRow(tt.locked))
+			if tt.locked {
+				unlock := mock.ExpectQuery("select pg_advisory_unlock\\(hashtext\\(\\$1\\)\\)").WithArgs("job-1")
+				if tt.unlockErr != nil {
+					unlock.WillReturnError(tt.unlockErr)
+				} else {
+					unlock.WillReturnRows(sqlmock.NewRows([]string{"pg_advisory_unlock"}).AddRow(true))
+				}
+			}
+
+			inner := &countingPropagator{err: tt.inner}
+			err = NewLockingPropagator(db, inner).Propagate(context.Background(), "job-1")
+			if !errors.Is(err, tt.expected) {
+				t.Errorf("Propagate() returned %v instead of %v", err, tt.expected)
+			}
+			if inner.calls != tt.propCalls {
+				t.Errorf("the wrapped propagator was called %d times instead of %d", inner.calls, tt.propCalls)
+			}
+
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestHandleSkipsLockedJobs(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	stats := &PropagationStats{}
+	h := &jobHandler{db: db, maxRetries: 3, propagator: &stubPropagator{err: ErrJobLocked}, stats: stats}
+	h.handle(context.Background(), "job-1", 0, NewRetryBudget(0))
+
+	if snap := stats.snapshot(); stats.Failed.Load() != 0 || stats.Deferred.Load() != 0 {
+		t.Errorf("the skipped job was counted: %+v", snap)
+	}
+
+	// The attempt isn't recorded in the database.
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -13,250 +13,2564 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	_ "expvar"
 	"flag"
 	"fmt"
-	"net"
+	"io"
+	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"runtime/pprof"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/cyverse-de/configurate"
 	"github.com/cyverse-de/dbutil"
 	"github.com/cyverse-de/go-mod/otelutils"
 	"github.com/cyverse-de/version"
-	_ "github.com/lib/pq"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 )
 
 const serviceName = "job-status-to-apps-adapter"
 const otelName = "github.com/cyverse-de/job-status-to-apps-adapter"
 
+// maxErrorBody is the default number of bytes of an error response body that
+// will be included in the error returned from Propagate.
+const maxErrorBody = 4096
+
+// outcomeTimeout limits how long recording the outcome of a propagation may
+// take once the propagation's own context is done.
+const outcomeTimeout = 30 * time.Second
+
 var log = logrus.WithFields(logrus.Fields{"service": serviceName})
-var httpClient = http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
 
-// JobStatusUpdate contains the data POSTed to the apps service.
+// appsTransport is the transport used for requests to the apps service. It's
+// configured from the command-line flags before the first request is sent.
+var appsTransport = http.DefaultTransport.(*http.Transport).Clone()
+var httpClient = http.Client{Transport: otelhttp.NewTransport(appsTransport)}
+
+// JobStatusUpdate contains the data POSTed to the apps service. ID, Status,
+// and SentOn come from a single row in job_status_updates, so that the apps
+// service can tell a job's updates apart.
 type JobStatusUpdate struct {
-	UUID string `json:"uuid"`
+	ID     string `json:"id,omitempty"`
+	UUID   string `json:"uuid"`
+	Status string `json:"status,omitempty"`
+	SentOn int64  `json:"sent_on,omitempty"`
+}
+
+// DBTX is the set of query methods shared by *sql.DB and *sql.Tx.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// ErrLockTimeout is returned by InTx when a statement in the transaction gave
+// up waiting for a lock because the lock timeout expired.
+var ErrLockTimeout = errors.New("timed out waiting for a database lock")
+
+// lockNotAvailable is the Postgres error code for lock timeouts.
+const lockNotAvailable = "55P03"
+
+// Timeouts are the Postgres timeouts for a transaction. Timeouts that are zero
+// are left at the server's defaults.
+type Timeouts struct {
+	Statement time.Duration
+	Lock      time.Duration
+
+	// IdleInTransaction ends the transaction if it's left idle for this long,
+	// so it must only be set for transactions that don't wait on anything
+	// else between statements.
+	IdleInTransaction time.Duration
+}
+
+// InTx calls fn with a new transaction, which is committed if fn succeeds and
+// rolled back otherwise. The timeouts only apply for the duration of the
+// transaction. Lock timeouts are reported as ErrLockTimeout.
+func InTx(ctx context.Context, d TxBeginner, timeouts Timeouts, fn func(*sql.Tx) error) error {
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	settings := []struct {
+		name    string
+		timeout time.Duration
+	}{
+		{"statement_timeout", timeouts.Statement},
+		{"lock_timeout", timeouts.Lock},
+		{"idle_in_transaction_session_timeout", timeouts.IdleInTransaction},
+	}
+	for _, setting := range settings {
+		if setting.timeout <= 0 {
+			continue
+		}
+		queryStr := fmt.Sprintf("set local %s = %d", setting.name, setting.timeout.Milliseconds())
+		if _, err = tx.ExecContext(ctx, queryStr); err != nil {
+			return err
+		}
+	}
+
+	// set_config with is_local set is SET LOCAL, but it accepts parameters.
+	if name := applicationName(ctx); name != "" {
+		if _, err = tx.ExecContext(ctx, "select set_config('application_name', $1, true)", name); err != nil {
+			return err
+		}
+	}
+
+	if err = fn(tx); err == nil {
+		err = tx.Commit()
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == lockNotAvailable {
+		return fmt.Errorf("%w: %s", ErrLockTimeout, err)
+	}
+	return err
+}
+
+// applicationName returns the Postgres application_name that links the
+// transactions started with the context to its span, or an empty string if the
+// context isn't being traced.
+func applicationName(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return ""
+	}
+	return fmt.Sprintf("jsta/%s/%s", sc.TraceID(), sc.SpanID())
+}
+
+// ExecInTx runs a single statement in its own transaction, e.g. for the
+// --pre-flight-sql and --post-flight-sql statements.
+func ExecInTx(ctx context.Context, d TxBeginner, timeouts Timeouts, query string) error {
+	return InTx(ctx, d, timeouts, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, query)
+		return err
+	})
+}
+
+// JobQuery describes the jobs with unpropagated status updates to look for.
+type JobQuery struct {
+	// MaxRetries excludes status updates that have already been attempted this
+	// many times.
+	MaxRetries int64
+
+	// DefaultPriority is used for status updates without a priority.
+	DefaultPriority int
+
+	// JobTypes limits the jobs to the given job types if it's not empty.
+	JobTypes []string
+
+	// MaxAge excludes jobs whose status updates were all sent longer ago than
+	// this if it's positive. Jobs with a recent update are still listed with
+	// their older updates, so that the updates are sent in order.
+	MaxAge time.Duration
+
+	// ExternalIDs limits the jobs to the given external IDs if it's not empty.
+	ExternalIDs []string
+
+	// Limit returns at most this many jobs, after skipping the first Offset
+	// jobs, if it's positive.
+	Limit  int
+	Offset int
+
+	// Stmts prepares the query once and reuses it if it's set.
+	Stmts *StmtCache
+}
+
+// SQL returns the query text and arguments used to list the matching jobs. Jobs
+// with a higher priority are listed first, followed by the jobs that have been
+// waiting the longest.
+func (q *JobQuery) SQL() (string, []any) {
+	args := []any{q.MaxRetries, q.DefaultPriority}
+	var joins, filters, having string
+
+	if len(q.JobTypes) > 0 {
+		args = append(args, pq.Array(q.JobTypes))
+		joins += `
+	  join job_steps s on s.external_id = u.external_id
+	  join job_types t on t.id = s.job_type_id`
+		filters += fmt.Sprintf(`
+	   and t.name = any($%d)`, len(args))
+	}
+
+	if len(q.ExternalIDs) > 0 {
+		args = append(args, pq.Array(q.ExternalIDs))
+		filters += fmt.Sprintf(`
+	   and u.external_id = any($%d)`, len(args))
+	}
+
+	if q.MaxAge > 0 {
+		args = append(args, pgInterval(q.MaxAge))
+		having = fmt.Sprintf(`
+	having max(u.sent_on) > %s`, sentOnCutoff(len(args)))
+	}
+
+	queryStr := fmt.Sprintf(`
+	select u.external_id
+	  from job_status_updates u%s
+	 where u.propagated = 'false'
+	   and u.propagation_attempts < $1%s
+	 group by u.external_id%s
+	 order by max(coalesce(u.priority, $2)) desc, min(u.sent_on) asc`, joins, filters, having)
+
+	if q.Limit > 0 {
+		args = append(args, q.Limit, q.Offset)
+		queryStr += fmt.Sprintf(`
+	 limit $%d offset $%d`, len(args)-1, len(args))
+	}
+
+	return queryStr, args
 }
 
 // Unpropagated returns a []string of the UUIDs for jobs that have steps that
 // haven't been propagated yet but haven't passed their retry limit.
-func Unpropagated(ctx context.Context, d *sql.DB, maxRetries int64) ([]string, error) {
-	queryStr := `
-	select distinct external_id
-	  from job_status_updates
-	 where propagated = 'false'
-	   and propagation_attempts < $1`
-	rows, err := d.QueryContext(ctx, queryStr, maxRetries)
+func Unpropagated(ctx context.Context, d DBTX, q *JobQuery) ([]string, error) {
+	queryStr, args := q.SQL()
+
+	start := time.Now()
+	rows, err := q.Stmts.QueryContext(ctx, d, queryStr, args...)
 	if err != nil {
 		return nil, err
 	}
+
+	prepared := strconv.FormatBool(q.Stmts != nil)
+	elapsed := time.Since(start)
+	unpropagatedQueryDuration.WithLabelValues(prepared).Observe(elapsed.Seconds())
+	log.Debugf("The unpropagated jobs query took %s (prepared: %s)", elapsed, prepared)
+
+	return scanExternalIDs(rows)
+}
+
+// scanExternalIDs reads the external IDs from the first column of each row and
+// closes the rows.
+func scanExternalIDs(rows *sql.Rows) ([]string, error) {
 	defer rows.Close()
 	var retval []string
 	for rows.Next() {
 		var extID string
-		err = rows.Scan(&extID)
+		err := rows.Scan(&extID)
 		if err != nil {
 			return nil, err
 		}
 		retval = append(retval, extID)
 	}
-	err = rows.Err()
+	err := rows.Err()
 	return retval, err
 }
 
-// Propagator looks for job status updates in the database and pushes them to
-// the apps service if they haven't been successfully pushed there yet.
-type Propagator struct {
-	db      *sql.DB
-	appsURI string
+// CountUnpropagated returns the number of jobs that Unpropagated would return.
+func CountUnpropagated(ctx context.Context, d DBTX, q *JobQuery) (int, error) {
+	var count int
+	queryStr, args := q.SQL()
+	err := d.QueryRowContext(ctx, "select count(*) from ("+queryStr+") as pending", args...).Scan(&count)
+	return count, err
 }
 
-// NewPropagator returns a *Propagator that has been initialized with a new
-// transaction.
-func NewPropagator(d *sql.DB, appsURI string) (*Propagator, error) {
-	var err error
-	if err != nil {
-		return nil, err
+// ForEachUnpropagatedBatch reads the jobs that Unpropagated would return in
+// batches of batchSize from a server-side cursor and calls fn with each batch.
+// Only one batch is held in memory at a time no matter how many jobs are
+// waiting. Iteration stops at the first error returned by fn. Cursors only
+// exist within a transaction, so tx must not be a *sql.DB.
+func ForEachUnpropagatedBatch(ctx context.Context, tx DBTX, q *JobQuery, batchSize int, fn func([]string) error) error {
+	queryStr, args := q.SQL()
+	if _, err := tx.ExecContext(ctx, "declare unpropagated_jobs no scroll cursor for "+queryStr, args...); err != nil {
+		return err
 	}
-	return &Propagator{
-		db:      d,
-		appsURI: appsURI,
-	}, nil
-}
 
-// Propagate pushes the update to the apps service.
-func (p *Propagator) Propagate(ctx context.Context, uuid string) error {
-	jsu := JobStatusUpdate{
-		UUID: uuid,
-	}
+	fetchStr := fmt.Sprintf("fetch forward %d from unpropagated_jobs", batchSize)
+	for {
+		rows, err := tx.QueryContext(ctx, fetchStr)
+		if err != nil {
+			return err
+		}
 
-	log.Infof("Job status in the propagate function for job %s is: %#v", jsu.UUID, jsu)
-	msg, err := json.Marshal(jsu)
-	if err != nil {
-		log.Error(err)
-		return err
-	}
+		batch, err := scanExternalIDs(rows)
+		if err != nil {
+			return err
+		}
 
-	buf := bytes.NewBuffer(msg)
-	if err != nil {
-		log.Error(err)
-		return err
+		if len(batch) == 0 {
+			break
+		}
+
+		if err = fn(batch); err != nil {
+			return err
+		}
 	}
 
-	log.Infof("Message to propagate: %s", string(msg))
+	return nil
+}
+
+// HasJobStatusUpdates returns true if the job_status_updates table has any rows
+// in it. An error usually means that the service is connected to the wrong
+// database.
+func HasJobStatusUpdates(ctx context.Context, d DBTX) (bool, error) {
+	var exists bool
+	err := d.QueryRowContext(ctx, "select exists (select 1 from job_status_updates limit 1)").Scan(&exists)
+	return exists, err
+}
 
-	log.Infof("Sending job status to %s in the propagate function for job %s", p.appsURI, jsu.UUID)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.appsURI, buf)
+// RetriedJobs returns the number of propagation attempts already made for each
+// job with unpropagated status updates that has failed to propagate at least
+// once but hasn't reached the retry limit.
+func RetriedJobs(ctx context.Context, d DBTX, maxRetries int64) (map[string]int64, error) {
+	queryStr := `
+	select external_id, max(propagation_attempts)
+	  from job_status_updates
+	 where propagated = 'false'
+	   and propagation_attempts > 0
+	   and propagation_attempts < $1
+	 group by external_id`
+	rows, err := d.QueryContext(ctx, queryStr, maxRetries)
 	if err != nil {
-		log.Errorf("Error sending job status to %s in the propagate function for job %s: %#v", p.appsURI, jsu.UUID, err)
-		return err
+		return nil, err
 	}
+	defer rows.Close()
+	retval := make(map[string]int64)
+	for rows.Next() {
+		var extID string
+		var attempts int64
+		err = rows.Scan(&extID, &attempts)
+		if err != nil {
+			return nil, err
+		}
+		retval[extID] = attempts
+	}
+	err = rows.Err()
+	return retval, err
+}
 
-	req.Header.Set("content-type", "application/json")
-
-	resp, err := httpClient.Do(req)
+// ExplainUnpropagated runs EXPLAIN ANALYZE on the query used by Unpropagated
+// and returns the query plan in JSON format. The query is actually executed by
+// Postgres, so this should only be used for debugging.
+func ExplainUnpropagated(ctx context.Context, d DBTX, q *JobQuery) (string, error) {
+	var plan string
+	queryStr, args := q.SQL()
+	err := d.QueryRowContext(ctx, "explain (analyze, format json) "+queryStr, args...).Scan(&plan)
 	if err != nil {
-		log.Errorf("Error sending job status to %s in the propagate function for job %s: %#v", p.appsURI, jsu.UUID, err)
-		return err
+		return "", err
 	}
-	defer resp.Body.Close()
+	return plan, nil
+}
 
-	log.Infof("Response from %s in the propagate function for job %s is: %s", p.appsURI, jsu.UUID, resp.Status)
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return errors.New("bad response")
-	}
+// ExhaustAttempts sets the propagation attempts for all of a job's unpropagated
+// status updates to maxRetries so that they won't be retried again.
+func ExhaustAttempts(ctx context.Context, d *sql.DB, externalID string, maxRetries int64) error {
+	queryStr := `
+	update job_status_updates
+	   set propagation_attempts = $2
+	 where external_id = $1
+	   and propagated = 'false'`
+	_, err := d.ExecContext(ctx, queryStr, externalID, maxRetries)
+	return err
+}
 
-	return nil
+// pgInterval formats d as a Postgres interval.
+func pgInterval(d time.Duration) string {
+	return fmt.Sprintf("%d milliseconds", d.Milliseconds())
 }
 
-func main() {
-	var (
-		cfgPath     = flag.String("config", "", "Path to the config file. Required.")
-		showVersion = flag.Bool("version", false, "Print the version information")
-		dbURI       = flag.String("db", "", "The URI used to connect to the database")
-		maxRetries  = flag.Int64("retries", 3, "The maximum number of propagation retries to make")
-		batchSize   = flag.Int("batch-size", 1000, "The number of concurrent jobs to process.")
-		err         error
-		cfg         *viper.Viper
-		db          *sql.DB
-		appsURI     string
-	)
+// sentOnCutoff returns the SQL expression for the sent_on value of a status
+// update sent the interval in the given parameter ago. sent_on is the number
+// of milliseconds since the epoch.
+func sentOnCutoff(param int) string {
+	return fmt.Sprintf("(extract(epoch from now() - $%d::interval) * 1000)::bigint", param)
+}
 
-	var tracerCtx, cancel = context.WithCancel(context.Background())
-	defer cancel()
-	shutdown := otelutils.TracerProviderFromEnv(tracerCtx, serviceName, func(e error) { log.Fatal(e) })
-	defer shutdown()
+// ExpiryQuery describes the jobs that are too old to propagate.
+type ExpiryQuery struct {
+	// MaxAge is the age past which a job's status updates are given up on.
+	MaxAge time.Duration
 
-	flag.Parse()
+	// MaxRetries excludes status updates that have already been attempted this
+	// many times.
+	MaxRetries int64
 
-	if *showVersion {
-		version.AppVersion()
-		os.Exit(0)
-	}
+	// SkipClaimed excludes the jobs claimed in the jobs_to_propagate staging
+	// table, which another replica may be propagating.
+	SkipClaimed bool
 
-	if *cfgPath == "" {
-		fmt.Println("Error: --config must be set.")
-		flag.PrintDefaults()
-		os.Exit(-1)
-	}
+	// SkipLocked excludes the jobs whose advisory lock is held by another
+	// session. The locks on the listed jobs are held until the transaction
+	// ends, so the query has to run in one.
+	SkipLocked bool
+}
 
-	cfg, err = configurate.InitDefaults(*cfgPath, configurate.JobServicesDefaults)
-	if err != nil {
-		log.Error(err)
-		os.Exit(-1)
+// SQL returns the query text and arguments used to list the expired jobs.
+func (q *ExpiryQuery) SQL() (string, []any) {
+	var filters string
+	if q.SkipClaimed {
+		filters += `
+	   and external_id not in (select external_id from jobs_to_propagate)`
 	}
 
-	log.Info("Done reading config.")
+	queryStr := fmt.Sprintf(`
+	select external_id
+	  from job_status_updates
+	 where propagated = 'false'
+	   and propagation_attempts < $2%s
+	 group by external_id
+	having max(sent_on) <= %s`, filters, sentOnCutoff(1))
 
-	if *dbURI == "" {
-		*dbURI = cfg.GetString("db.uri")
-	} else {
-		cfg.Set("db.uri", *dbURI)
+	// The locks are only taken for the jobs that are otherwise expired.
+	if q.SkipLocked {
+		queryStr = `
+	select external_id from (` + queryStr + `) as expired
+	 where pg_try_advisory_xact_lock(hashtext(external_id))`
 	}
 
-	appsURI = cfg.GetString("apps.callbacks_uri")
+	return queryStr, []any{pgInterval(q.MaxAge), q.MaxRetries}
+}
 
-	log.Info("Connecting to the database...")
-	connector, err := dbutil.NewDefaultConnector("1m")
+// ExpiredJobs returns the jobs whose unpropagated status updates that haven't
+// passed their retry limit were all sent longer ago than the query's MaxAge.
+func ExpiredJobs(ctx context.Context, d DBTX, q *ExpiryQuery) ([]string, error) {
+	queryStr, args := q.SQL()
+	rows, err := d.QueryContext(ctx, queryStr, args...)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	return scanExternalIDs(rows)
+}
+
+// ExpireJobs uses up the remaining attempts for the unpropagated status
+// updates of each of the jobs so that they aren't retried.
+func ExpireJobs(ctx context.Context, d DBTX, externalIDs []string, maxRetries int64) error {
+	queryStr := `
+	update job_status_updates
+	   set propagation_attempts = $2
+	 where external_id = any($1)
+	   and propagated = 'false'`
+	_, err := d.ExecContext(ctx, queryStr, pq.Array(externalIDs), maxRetries)
+	return err
+}
 
-	db, err = connector.Connect("postgres", *dbURI)
+// UnpropagatedUpdates returns the job's unpropagated status updates in the
+// order they were sent.
+func UnpropagatedUpdates(ctx context.Context, d DBTX, externalID string) ([]JobStatusUpdate, error) {
+	queryStr := `
+	select id, status, sent_on
+	  from job_status_updates
+	 where external_id = $1
+	   and propagated = 'false'
+	 order by sent_on asc`
+	rows, err := d.QueryContext(ctx, queryStr, externalID)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	defer rows.Close()
 
-	if err = db.Ping(); err != nil {
-		log.Fatal(err)
+	var retval []JobStatusUpdate
+	for rows.Next() {
+		jsu := JobStatusUpdate{UUID: externalID}
+		if err = rows.Scan(&jsu.ID, &jsu.Status, &jsu.SentOn); err != nil {
+			return nil, err
+		}
+		retval = append(retval, jsu)
 	}
-	log.Info("Connected to the database")
+	return retval, rows.Err()
+}
 
-	go func() {
-		sock, err := net.Listen("tcp", "0.0.0.0:60000")
-		if err != nil {
-			log.Fatal(err)
+// MarkUpdatePropagated marks the status update with the given ID as propagated
+// so that it isn't picked up again.
+func MarkUpdatePropagated(ctx context.Context, d DBTX, id string) error {
+	queryStr := `
+	update job_status_updates
+	   set propagated = 'true'
+	 where id = $1`
+	_, err := d.ExecContext(ctx, queryStr, id)
+	return err
+}
+
+// propagateInOrder calls send for each of the job's unpropagated status
+// updates in the order they were sent, marking each one as propagated as soon
+// as it succeeds. It stops at the first failure so that later updates are
+// never delivered ahead of earlier ones.
+func propagateInOrder(ctx context.Context, d *sql.DB, uuid string, send func(context.Context, JobStatusUpdate) error) error {
+	updates, err := UnpropagatedUpdates(ctx, d, uuid)
+	if err != nil {
+		return pkgerrors.WithStack(err)
+	}
+	for _, jsu := range updates {
+		if err = send(ctx, jsu); err != nil {
+			return err
 		}
-		err = http.Serve(sock, nil)
+		err = InTx(ctx, d, Timeouts{}, func(tx *sql.Tx) error {
+			return MarkUpdatePropagated(ctx, tx, jsu.ID)
+		})
 		if err != nil {
-			log.Fatal(err)
+			return pkgerrors.WithStack(err)
 		}
-	}()
+	}
+	return nil
+}
 
-	for {
-		ctx, span := otel.Tracer(otelName).Start(context.Background(), "propagation loop")
-		var batches [][]string
-		var wg sync.WaitGroup
+// IncrementAttempts records a failed attempt to propagate the job's unpropagated
+// status updates. The last_propagation_attempt column it sets is added by
+// Migrate.
+func IncrementAttempts(ctx context.Context, d *sql.DB, externalID string) error {
+	queryStr := `
+	update job_status_updates
+	   set propagation_attempts = propagation_attempts + 1,
+	       last_propagation_attempt = $2
+	 where external_id = $1
+	   and propagated = 'false'`
+	_, err := d.ExecContext(ctx, queryStr, externalID, time.Now().UnixMilli())
+	return err
+}
+
+// ResetStaleRetries resets the propagation attempts of unpropagated status
+// updates that were last attempted before the given time, so that jobs that
+// failed during a temporary outage are retried. It returns the number of status
+// updates that were reset.
+func ResetStaleRetries(ctx context.Context, d *sql.DB, before time.Time) (int64, error) {
+	queryStr := `
+	update job_status_updates
+	   set propagation_attempts = 0
+	 where propagated = 'false'
+	   and propagation_attempts > 0
+	   and last_propagation_attempt < $1`
+	result, err := d.ExecContext(ctx, queryStr, before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
 
-		unpropped, err := Unpropagated(ctx, db, *maxRetries)
+// ResetRetriesPeriodically calls ResetStaleRetries for the status updates last
+// attempted more than resetInterval ago, once at startup and then at least
+// hourly, until the context is done.
+func ResetRetriesPeriodically(ctx context.Context, d *sql.DB, resetInterval time.Duration) {
+	reset := func() {
+		count, err := ResetStaleRetries(ctx, d, time.Now().Add(-resetInterval))
 		if err != nil {
-			span.End()
-			log.Fatal(err)
+			log.Errorf("Error resetting stale propagation attempts: %s", err)
+			return
+		}
+		if count > 0 {
+			log.Infof("Reset the propagation attempts of %d status updates last attempted more than %s ago", count, resetInterval)
 		}
+	}
+
+	reset()
 
-		for *batchSize < len(unpropped) {
-			unpropped, batches = unpropped[*batchSize:], append(batches, unpropped[0:*batchSize])
+	ticker := time.NewTicker(min(resetInterval, time.Hour))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reset()
 		}
-		batches = append(batches, unpropped)
+	}
+}
 
-		for _, batch := range batches {
-			for _, jobExtID := range batch {
-				wg.Add(1)
+// ResponseError is returned by Propagate when the apps service responds with a
+// status code outside of the 2xx range.
+type ResponseError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
 
-				go func(ctx context.Context, db *sql.DB, maxRetries int64, appsURI string, jobExtID string) {
-					defer wg.Done()
-					separatedSpanContext := trace.SpanContextFromContext(ctx)
-					outerCtx := trace.ContextWithSpanContext(context.Background(), separatedSpanContext)
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("apps returned %d: %s", e.StatusCode, e.Body)
+}
 
-					ctx, span := otel.Tracer(otelName).Start(outerCtx, "propagator goroutine")
-					defer span.End()
+// RetryPolicy determines whether a failed propagation should be attempted again
+// on a later pass.
+type RetryPolicy struct {
+	RetryOn   map[int]bool
+	NoRetryOn map[int]bool
+}
 
-					proper, err := NewPropagator(db, appsURI)
-					if err != nil {
-						log.Error(err)
-					}
+// Retryable returns true if a response with the given status code should be
+// retried. Status codes in NoRetryOn are never retried. Otherwise, all status
+// codes are retryable if RetryOn is empty.
+func (rp *RetryPolicy) Retryable(statusCode int) bool {
+	if rp.NoRetryOn[statusCode] {
+		return false
+	}
+	if len(rp.RetryOn) == 0 {
+		return true
+	}
+	return rp.RetryOn[statusCode]
+}
 
-					if err = proper.Propagate(ctx, jobExtID); err != nil {
-						log.Error(err)
-					}
+// RetryBudget limits the number of retry attempts made during a single
+// propagation pass, counting both the jobs that failed in an earlier pass and
+// each in-process retry made by RetryingPropagator. It's safe for concurrent
+// use. A nil *RetryBudget is unlimited.
+type RetryBudget struct {
+	limit int64
+	used  atomic.Int64
+}
 
-				}(ctx, db, *maxRetries, appsURI, jobExtID)
-			}
+// NewRetryBudget returns a *RetryBudget that allows up to limit retry attempts.
+// A limit of zero or less allows an unlimited number of attempts.
+func NewRetryBudget(limit int64) *RetryBudget {
+	return &RetryBudget{limit: limit}
+}
+
+// Take consumes a retry attempt from the budget, returning false if the budget
+// has already been used up.
+func (b *RetryBudget) Take() bool {
+	if b == nil || b.limit <= 0 {
+		return true
+	}
+	return b.used.Add(1) <= b.limit
+}
+
+// Exhausted returns true if more retry attempts were requested than the budget
+// allows.
+func (b *RetryBudget) Exhausted() bool {
+	return b != nil && b.limit > 0 && b.used.Load() > b.limit
+}
+
+type retryBudgetKey struct{}
+
+// WithRetryBudget returns a copy of the context that carries the pass's retry
+// budget, so that RetryingPropagator can take its retries from it.
+func WithRetryBudget(ctx context.Context, budget *RetryBudget) context.Context {
+	return context.WithValue(ctx, retryBudgetKey{}, budget)
+}
+
+// retryBudgetFromContext returns the retry budget recorded by WithRetryBudget,
+// or nil if there isn't one.
+func retryBudgetFromContext(ctx context.Context) *RetryBudget {
+	budget, _ := ctx.Value(retryBudgetKey{}).(*RetryBudget)
+	return budget
+}
+
+// ParseStatusCodes parses a comma-separated list of HTTP status codes.
+func ParseStatusCodes(list string) (map[int]bool, error) {
+	retval := make(map[int]bool)
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		code, err := strconv.Atoi(field)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid HTTP status code: %s", field)
+		}
+		retval[code] = true
+	}
+	return retval, nil
+}
 
-			wg.Wait()
+// SampleJobs returns a random subset of jobs where each job is kept with the
+// given probability. The order of the kept jobs is preserved. Jobs that aren't
+// kept stay unpropagated in the database and get picked up on a later pass.
+func SampleJobs(jobs []string, rate float64, rng *rand.Rand) []string {
+	if rate >= 1.0 {
+		return jobs
+	}
+	var retval []string
+	for _, job := range jobs {
+		if rng.Float64() < rate {
+			retval = append(retval, job)
 		}
+	}
+	return retval
+}
 
-		span.End()
+// CompileJobIDRegex compiles a pattern that external IDs must match in their
+// entirety.
+func CompileJobIDRegex(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// ReadJobIDs reads newline-separated job UUIDs from r until EOF. Blank lines are
+// ignored and lines that aren't valid UUIDs are skipped with a warning.
+func ReadJobIDs(r io.Reader) ([]string, error) {
+	var retval []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if _, err := uuid.Parse(line); err != nil {
+			log.Warnf("Skipping malformed job ID %q: %s", line, err)
+			malformedUUIDs.Inc()
+			continue
+		}
+		retval = append(retval, line)
+	}
+	return retval, scanner.Err()
+}
+
+// ValidExternalID returns true if the job's external ID is a valid UUID. Jobs
+// with malformed IDs are logged and counted in malformed_uuid_total.
+func ValidExternalID(ctx context.Context, jobExtID string) bool {
+	if _, err := uuid.Parse(jobExtID); err != nil {
+		loggerFromContext(ctx).Warnf("Skipping job with a malformed external ID %q: %s", jobExtID, err)
+		malformedUUIDs.Inc()
+		return false
+	}
+	return true
+}
+
+type attemptKey struct{}
+
+// WithAttempt returns a copy of the context that records which propagation
+// attempt is being made for a job, starting at 1.
+func WithAttempt(ctx context.Context, attempt int64) context.Context {
+	return context.WithValue(ctx, attemptKey{}, attempt)
+}
+
+// attemptFromContext returns the propagation attempt recorded by WithAttempt,
+// defaulting to the first attempt.
+func attemptFromContext(ctx context.Context) int64 {
+	if attempt, ok := ctx.Value(attemptKey{}).(int64); ok {
+		return attempt
+	}
+	return 1
+}
+
+type batchIDKey struct{}
+
+// WithBatchID returns a copy of the context that records the ID of the
+// propagation pass that the work done with it belongs to.
+func WithBatchID(ctx context.Context, batchID string) context.Context {
+	return context.WithValue(ctx, batchIDKey{}, batchID)
+}
+
+type loggerKey struct{}
+
+// WithLogFields returns a copy of the context whose logger, as returned by
+// loggerFromContext, includes the fields.
+func WithLogFields(ctx context.Context, fields logrus.Fields) context.Context {
+	return context.WithValue(ctx, loggerKey{}, loggerFromContext(ctx).WithFields(fields))
+}
+
+// loggerFromContext returns the logger recorded by WithLogFields. Otherwise, it
+// returns the package logger with the batch ID recorded by WithBatchID added to
+// it, if there is one.
+func loggerFromContext(ctx context.Context) *logrus.Entry {
+	if entry, ok := ctx.Value(loggerKey{}).(*logrus.Entry); ok {
+		return entry
+	}
+	if batchID, ok := ctx.Value(batchIDKey{}).(string); ok {
+		return log.WithField("batch_id", batchID)
+	}
+	return log
+}
+
+// ParseCallbackMethod validates the HTTP method used to send updates to the apps
+// service, which must be POST, PUT, or PATCH.
+func ParseCallbackMethod(method string) (string, error) {
+	method = strings.ToUpper(strings.TrimSpace(method))
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		return method, nil
+	default:
+		return "", fmt.Errorf("unsupported HTTP method %q; use POST, PUT, or PATCH", method)
+	}
+}
+
+// PropagatorOptions contains the settings shared by all of the propagators.
+type PropagatorOptions struct {
+	// Method is the HTTP method used to send updates to the apps service.
+	// Defaults to POST.
+	Method string
+
+	// IdempotencyKeyHeader is the request header used to send a key that's
+	// unique to each status update and attempt, which the apps service can use
+	// to ignore duplicate deliveries. No key is sent if it's empty.
+	IdempotencyKeyHeader string
+
+	// WireLogger logs the timings of requests to the apps service if it's set.
+	WireLogger *WireLogger
+
+	// ReuseTracker records whether connections to the apps service are reused
+	// if it's set.
+	ReuseTracker *ConnectionReuseTracker
+
+	// BodyHash adds the SHA256 hash of each request body to the request log
+	// entries and only logs the body itself at the debug level.
+	BodyHash bool
+
+	// LogRequestIDs logs the X-Request-ID header of each response from the
+	// apps service at the debug level.
+	LogRequestIDs bool
+
+	// OnBackpressure is called with the signal in each X-Backpressure response
+	// header if it's set.
+	OnBackpressure func(Backpressure)
+
+	// StructuredErrors wraps the errors returned by Propagate in a
+	// *StructuredError.
+	StructuredErrors bool
+
+	// RequestTimeout limits how long each request to the apps service may take,
+	// including reading the response. Requests aren't limited if it's zero.
+	RequestTimeout time.Duration
+
+	// Deduplicate asks the apps service whether it already processed a job
+	// before sending its update, and skips the update if it did. The update
+	// is sent anyway if the apps service can't answer.
+	Deduplicate bool
+
+	// CircuitBreaker configures a circuit breaker for each apps service
+	// instance, which stops sending updates to an instance that keeps failing.
+	CircuitBreaker CircuitBreakerSettings
+
+	// SigningKey is used to sign each request body with HMAC-SHA256 in the
+	// X-Signature header. Requests aren't signed if it's empty.
+	SigningKey []byte
+
+	// MaxResponseBody is the number of bytes of an error response body that
+	// are included in the error. It defaults to maxErrorBody if it's zero.
+	MaxResponseBody int64
+}
+
+// Propagator looks for job status updates in the database and pushes them to
+// the apps service if they haven't been successfully pushed there yet.
+type Propagator struct {
+	db      *sql.DB
+	appsURI string
+	logURI  string
+	opts    *PropagatorOptions
+	breaker *CircuitBreaker
+}
+
+// NewPropagator returns a *Propagator that has been initialized with a new
+// transaction. The default options are used if opts is nil.
+func NewPropagator(d *sql.DB, appsURI string, opts *PropagatorOptions) (*Propagator, error) {
+	var err error
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &PropagatorOptions{}
+	}
+	p := &Propagator{
+		db:      d,
+		appsURI: appsURI,
+		logURI:  MaskAppsURI(appsURI),
+		opts:    opts,
+	}
+	if opts.CircuitBreaker.Threshold > 0 {
+		p.breaker = NewCircuitBreaker(opts.CircuitBreaker)
+	}
+	return p, nil
+}
+
+// readErrorBody returns up to limit bytes of the response body, decompressing it
+// first if the apps service gzipped it.
+func readErrorBody(resp *http.Response, limit int64) (string, error) {
+	var r io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	b, err := io.ReadAll(io.LimitReader(r, limit))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Propagate pushes the job's status updates to the apps service in the order
+// they were sent and marks each one as propagated once it's been accepted.
+func (p *Propagator) Propagate(ctx context.Context, uuid string) error {
+	return p.wrapError(uuid, propagateInOrder(ctx, p.db, uuid, p.sendUpdate))
+}
+
+// wrapError wraps an error from propagating the job in a *StructuredError if
+// structured errors are enabled.
+func (p *Propagator) wrapError(uuid string, err error) error {
+	if err != nil && p.opts.StructuredErrors {
+		return NewStructuredError(uuid, err)
+	}
+	return err
+}
+
+// sendUpdate pushes the update to the apps service without updating the database.
+// It returns ErrCircuitOpen without sending anything while the circuit breaker
+// is open.
+func (p *Propagator) sendUpdate(ctx context.Context, jsu JobStatusUpdate) (err error) {
+	log := loggerFromContext(ctx)
+
+	if p.breaker != nil {
+		if err = p.breaker.Allow(); err != nil {
+			return err
+		}
+		defer func() {
+			// Only failures that suggest the service itself is down count.
+			p.breaker.Record(err == nil || !IsTransient(err))
+		}()
+	}
+
+	log.Infof("Job status in the propagate function for job %s is: %#v", jsu.UUID, jsu)
+	msg, err := json.Marshal(jsu)
+	if err != nil {
+		log.Error(err)
+		return pkgerrors.WithStack(err)
+	}
+
+	buf := bytes.NewBuffer(msg)
+	if err != nil {
+		log.Error(err)
+		return pkgerrors.WithStack(err)
+	}
+
+	if p.opts.BodyHash {
+		sum := sha256.Sum256(msg)
+		log = log.WithField("body_sha256", hex.EncodeToString(sum[:]))
+		log.Debugf("Message to propagate: %s", string(msg))
+	} else {
+		log.Infof("Message to propagate: %s", string(msg))
+	}
+
+	log.Infof("Sending job status to %s in the propagate function for job %s", p.logURI, jsu.UUID)
+	if p.opts.WireLogger != nil {
+		ctx = p.opts.WireLogger.Trace(ctx)
+	}
+	if p.opts.ReuseTracker != nil {
+		ctx = p.opts.ReuseTracker.Trace(ctx)
+	}
+
+	method := p.opts.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	if p.opts.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.opts.RequestTimeout)
+		defer cancel()
+	}
+
+	if p.opts.Deduplicate {
+		processed, err := p.AlreadyProcessed(ctx, jsu.UUID, jsu.ID)
+		if err != nil {
+			log.Warnf("Unable to check whether status update %s for job %s was already processed; sending it anyway: %s", jsu.ID, jsu.UUID, err)
+		} else if processed {
+			log.Infof("The apps service at %s already processed status update %s for job %s; not sending it again", p.logURI, jsu.ID, jsu.UUID)
+			return nil
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.appsURI, buf)
+	if err != nil {
+		log.Errorf("Error sending job status to %s in the propagate function for job %s: %#v", p.logURI, jsu.UUID, err)
+		return pkgerrors.WithStack(err)
+	}
+
+	req.Header.Set("content-type", "application/json")
+	if len(p.opts.SigningKey) > 0 {
+		req.Header.Set(SignatureHeader, SignBody(p.opts.SigningKey, msg))
+	}
+
+	if p.opts.IdempotencyKeyHeader != "" {
+		updateID := jsu.ID
+		if updateID == "" {
+			updateID = jsu.UUID
+		}
+		key := fmt.Sprintf("%s-%d", updateID, attemptFromContext(ctx))
+		req.Header.Set(p.opts.IdempotencyKeyHeader, key)
+		log.Infof("Idempotency key for job %s is %s", jsu.UUID, key)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		err = maskURLError(err)
+		log.Errorf("Error sending job status to %s in the propagate function for job %s: %#v", p.logURI, jsu.UUID, err)
+		return pkgerrors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	log.Infof("Response from %s in the propagate function for job %s is: %s", p.logURI, jsu.UUID, resp.Status)
+	if value := resp.Header.Get("X-Backpressure"); value != "" && p.opts.OnBackpressure != nil {
+		signal, err := ParseBackpressure(value)
+		if err != nil {
+			log.Warn(err)
+		} else {
+			log.Infof("The apps service at %s asked for backpressure: %s", p.logURI, value)
+			p.opts.OnBackpressure(signal)
+		}
+	}
+
+	if p.opts.LogRequestIDs {
+		if requestID := resp.Header.Get("X-Request-ID"); requestID != "" {
+			log.WithField("request_id", requestID).Debugf("The apps service request ID for job %s is %s", jsu.UUID, requestID)
+		}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		limit := p.opts.MaxResponseBody
+		if limit <= 0 {
+			limit = maxErrorBody
+		}
+		body, err := readErrorBody(resp, limit)
+		if err != nil {
+			log.Errorf("Error reading the response body from %s for job %s: %s", p.logURI, jsu.UUID, err)
+		}
+		return pkgerrors.WithStack(&ResponseError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       strings.TrimSpace(body),
+		})
+	}
+
+	return nil
+}
+
+// jobHandler propagates the status updates for a single job and records the
+// outcome in the database.
+type jobHandler struct {
+	db             *sql.DB
+	maxRetries     int64
+	propagator     JobPropagator
+	retryPolicy    *RetryPolicy
+	stats          *PropagationStats
+	traceFailures  bool
+	maxStackFrames int
+
+	// errorBudget records the outcome of each propagation if it's set.
+	errorBudget *ErrorBudget
+
+	// deadLetters enables writing jobs that have used up all of their attempts
+	// to the job_propagation_dead_letters table.
+	deadLetters bool
+
+	// events records each state change if it's set.
+	events *EventStore
+
+	// dryRun stops failed propagations from being recorded in the database.
+	dryRun bool
+}
+
+// recordEvent records a state change for the job, logging any errors instead
+// of returning them so that the audit trail can't hold up propagation.
+func (h *jobHandler) recordEvent(ctx context.Context, jobExtID string, eventType EventType, payload map[string]any) {
+	if err := h.events.Record(ctx, jobExtID, eventType, payload); err != nil {
+		loggerFromContext(ctx).Errorf("Error recording the %s event for job %s: %s", eventType, jobExtID, err)
+	}
+}
+
+// stackTracer is implemented by errors created with github.com/pkg/errors.
+type stackTracer interface {
+	StackTrace() pkgerrors.StackTrace
+}
+
+// stackFrames returns up to maxFrames frames from the stack trace attached to
+// err, formatted as "function (file:line)". The caller's stack is used if err
+// doesn't have a stack trace attached to it.
+func stackFrames(err error, maxFrames int) []string {
+	var trace pkgerrors.StackTrace
+	var st stackTracer
+	if errors.As(err, &st) {
+		trace = st.StackTrace()
+	} else {
+		trace = pkgerrors.WithStack(err).(stackTracer).StackTrace()[1:]
+	}
+
+	if len(trace) > maxFrames {
+		trace = trace[:maxFrames]
+	}
+
+	var retval []string
+	for _, frame := range trace {
+		retval = append(retval, fmt.Sprintf("%n (%s:%d)", frame, frame, frame))
+	}
+	return retval
+}
+
+// handle propagates the job's status updates, given the number of attempts that
+// have already been made. Jobs that have failed before are only attempted if
+// there's room left in the retry budget.
+func (h *jobHandler) handle(ctx context.Context, jobExtID string, attempts int64, budget *RetryBudget) {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "propagator goroutine")
+	defer span.End()
+
+	fields := logrus.Fields{"job_id": jobExtID}
+	if traceID := span.SpanContext().TraceID(); traceID.IsValid() {
+		fields["trace_id"] = traceID.String()
+	}
+	ctx = WithLogFields(ctx, fields)
+	log := loggerFromContext(ctx)
+
+	if attempts > 0 && !budget.Take() {
+		log.Debugf("Retry budget exhausted; deferring job %s to the next pass", jobExtID)
+		h.stats.Deferred.Add(1)
+		return
+	}
+
+	h.recordEvent(ctx, jobExtID, EventPropagationAttempted, map[string]any{"attempt": attempts + 1})
+
+	start := time.Now()
+	err := h.propagator.Propagate(WithRetryBudget(WithAttempt(ctx, attempts+1), budget), jobExtID)
+	if errors.Is(err, ErrJobLocked) {
+		log.Debugf("Skipping job %s because another instance is propagating it", jobExtID)
+		return
+	}
+	if errors.Is(err, ErrCircuitOpen) {
+		log.Debugf("The circuit breaker is open; deferring job %s to the next pass", jobExtID)
+		h.stats.Deferred.Add(1)
+		return
+	}
+	jobPropagationDuration.Observe(time.Since(start).Seconds())
+	jobPropagationAttempts.Inc()
+
+	// The outcome is recorded even if the batch or pass timed out during the
+	// propagation, so that a job that keeps timing out uses up its attempts.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), outcomeTimeout)
+	defer cancel()
+
+	if err != nil {
+		jobPropagations.WithLabelValues("failure").Inc()
+
+		entry := log
+		var structErr *StructuredError
+		if errors.As(err, &structErr) {
+			entry = entry.WithFields(structErr.Fields())
+		}
+		if h.traceFailures {
+			entry = entry.WithField("stack", stackFrames(err, h.maxStackFrames))
+		}
+		entry.Error(err)
+		h.stats.Failed.Add(1)
+		if h.errorBudget != nil {
+			h.errorBudget.Record(true)
+		}
+		if h.dryRun {
+			return
+		}
+
+		if err := IncrementAttempts(ctx, h.db, jobExtID); err != nil {
+			log.Errorf("Error recording the failed attempt for job %s: %s", jobExtID, err)
+		}
+
+		lastError := err.Error()
+		exhausted := attempts+1 >= h.maxRetries
+		h.recordEvent(ctx, jobExtID, EventPropagationFailed, map[string]any{"attempt": attempts + 1, "error": lastError})
+
+		var respErr *ResponseError
+		if errors.As(err, &respErr) && !h.retryPolicy.Retryable(respErr.StatusCode) {
+			log.Warnf("Not retrying job %s after a %s response: %s", jobExtID, respErr.Status, respErr.Body)
+			if err = ExhaustAttempts(ctx, h.db, jobExtID, h.maxRetries); err != nil {
+				log.Error(err)
+			}
+			exhausted = true
+		}
+
+		if exhausted {
+			h.recordEvent(ctx, jobExtID, EventMaxRetriesReached, map[string]any{"attempts": attempts + 1, "error": lastError})
+		}
+		if exhausted && h.deadLetters {
+			if err = MarkDeadLetter(ctx, h.db, jobExtID, lastError); err != nil {
+				log.Errorf("Error writing a dead letter for job %s: %s", jobExtID, err)
+			}
+		}
+		return
+	}
+
+	jobPropagations.WithLabelValues("success").Inc()
+	h.stats.Succeeded.Add(1)
+	h.recordEvent(ctx, jobExtID, EventPropagationSucceeded, map[string]any{"attempt": attempts + 1, "duration_ms": time.Since(start).Milliseconds()})
+	if h.errorBudget != nil {
+		h.errorBudget.Record(false)
+	}
+}
+
+// expire permanently fails the jobs matched by the query, writing them to the
+// dead letters table if it's enabled, so that a backlog left by an outage
+// doesn't get retried indefinitely. The dead letters and the attempts are
+// written in a single transaction, so a failure doesn't leave duplicate dead
+// letters behind for the next pass.
+func (h *jobHandler) expire(ctx context.Context, d TxBeginner, timeouts Timeouts, q *ExpiryQuery) error {
+	reason := fmt.Sprintf("the status updates are older than the maximum age of %s", q.MaxAge)
+
+	var expired []string
+	err := InTx(ctx, d, timeouts, func(tx *sql.Tx) error {
+		var err error
+		if expired, err = ExpiredJobs(ctx, tx, q); err != nil || len(expired) == 0 {
+			return err
+		}
+		if h.deadLetters {
+			for _, jobExtID := range expired {
+				if err = MarkDeadLetter(ctx, tx, jobExtID, reason); err != nil {
+					return fmt.Errorf("unable to write a dead letter for job %s: %w", jobExtID, err)
+				}
+			}
+		}
+		return ExpireJobs(ctx, tx, expired, q.MaxRetries)
+	})
+	if err != nil || len(expired) == 0 {
+		return err
+	}
+
+	for _, jobExtID := range expired {
+		h.recordEvent(ctx, jobExtID, EventMaxRetriesReached, map[string]any{"error": reason})
+	}
+	log.WithField("jobs", expired).Warnf("Gave up on %d jobs because %s", len(expired), reason)
+	return nil
+}
+
+// waitForPass blocks until the next propagation pass should start or the
+// context is done. Every pass waits for a tick except the first one when
+// onStartup is set, so a backlog left by a restart doesn't sit idle for a whole
+// poll interval.
+func waitForPass(ctx context.Context, pass int, onStartup bool, tick <-chan time.Time) {
+	if pass > 0 || !onStartup {
+		select {
+		case <-ctx.Done():
+		case <-tick:
+		}
+	}
+}
+
+func main() {
+	var (
+		cfgPath     = flag.String("config", "", "Path to the config file. Required.")
+		showVersion = flag.Bool("version", false, "Print the version information")
+		dumpConfig  = flag.Bool("dump-config", false, "Print the resolved configuration as YAML, with sensitive values redacted, and exit")
+		dbURI       = flag.String("db", "", "The URI used to connect to the database")
+		maxRetries  = flag.Int64("retries", 3, "The maximum number of propagation retries to make")
+		batchSize   = flag.Int("batch-size", 1000, "The number of concurrent jobs to process.")
+		metricsOn   = flag.Bool("metrics-enabled", true, "Serve the metrics endpoint on --metrics-port")
+		sampleRate  = flag.Float64("jobs-sample-rate", 1.0, "The fraction of unpropagated jobs (0.0-1.0) to propagate on each pass")
+		sampleSeed  = flag.Int64("jobs-sample-seed", 0, "The seed used when sampling jobs. Defaults to the current time.")
+		retryOn     = flag.String("retry-on-status-codes", "", "Comma-separated HTTP status codes that trigger a retry. Defaults to all of them.")
+		noRetryOn   = flag.String("no-retry-on-status-codes", "", "Comma-separated HTTP status codes that are never retried.")
+		urisFile    = flag.String("apps-uris-file", "", "Path to a file listing apps callback URIs, one per line, that all receive each update")
+		queryPlan   = flag.Bool("query-plan-analyze", false, "Log the EXPLAIN ANALYZE output for the unpropagated jobs query. Requires debug logging.")
+		redirects   = flag.Bool("apps-redirect-follow", true, "Follow HTTP redirects returned by the apps service")
+		keepAlive   = flag.Bool("enable-keep-alive", true, "Reuse connections to the apps service between requests")
+		defPriority = flag.Int("default-job-priority", 5, "The priority given to job status updates without one. Higher priorities are propagated first.")
+		retryBudget = flag.Int64("retry-budget-per-pass", 500, "The maximum number of retry attempts in a single pass, counting each previously failed job and each retry made with --transient-retries. Zero means no limit.")
+		metadataURL = flag.String("metadata-url", "", "The cloud instance metadata URL, e.g. http://169.254.169.254/latest/meta-data/")
+		grpcHealth  = flag.Bool("enable-grpc-health", false, "Serve the gRPC health checking protocol")
+		grpcPort    = flag.Int("grpc-port", 50051, "The port to serve the gRPC health checking protocol on")
+		jobTypes    = flag.String("job-type-filter", "", "Comma-separated job types to propagate status updates for. Defaults to all job types.")
+		snapshotMin = flag.Int("snapshot-threshold", 50000, "Read pending jobs from a database cursor one batch at a time when more than this many are waiting. Zero disables the cursor.")
+		stmtTimeout = flag.Duration("db-statement-timeout", 0, "The Postgres statement timeout for the queries that look up pending jobs, e.g. 30s. Zero means no timeout.")
+		lockTimeout = flag.Duration("db-max-lock-timeout", 0, "The Postgres lock timeout for the queries that look up pending jobs, e.g. 10s. Zero means no timeout.")
+		dumpPath    = flag.String("debug-dump-path", "/tmp/jsta-dump.json", "The file the service's state is written to when it receives SIGUSR1")
+		once        = flag.Bool("once", false, "Run a single propagation pass and exit")
+		cpuProfile  = flag.Bool("enable-cpu-profiling", false, "Write a CPU profile to --cpu-profile-path when the service exits")
+		profilePath = flag.String("cpu-profile-path", "cpu.pprof", "The file the CPU profile is written to")
+		traceFails  = flag.Bool("trace-propagation-failures", false, "Include a stack trace in the log entries for failed propagations")
+		maxFrames   = flag.Int("max-stack-frames", 10, "The maximum number of stack frames logged by --trace-propagation-failures")
+		tlsCert     = flag.String("apps-tls-cert", "", "Path to the PEM-encoded client certificate presented to the apps service. Reloaded when it changes.")
+		tlsKey      = flag.String("apps-tls-key", "", "Path to the PEM-encoded private key for --apps-tls-cert")
+		tlsCA       = flag.String("apps-tls-ca", "", "Path to the PEM-encoded CA certificates used to verify the apps service's certificate instead of the system roots")
+		poolStats   = flag.Duration("db-pool-stats-interval", 60*time.Second, "How often to record the database connection pool statistics. Zero disables them.")
+		randomize   = flag.Bool("randomize-order", false, "Shuffle the pending jobs before splitting them into batches")
+		idemHeader  = flag.String("idempotency-key-header", "Idempotency-Key", "The header used to send a per-attempt idempotency key to the apps service. Empty disables the key.")
+		validateID  = flag.Bool("validate-uuid", false, "Skip jobs whose external IDs aren't valid UUIDs")
+		checkApps   = flag.Bool("check-apps-service-version", false, "Check the apps service version before propagating anything")
+		minApps     = flag.String("min-apps-version", "2.9.0", "The oldest apps service version supported by --check-apps-service-version")
+		strictApps  = flag.Bool("strict-version-check", false, "Exit if the apps service version check fails instead of logging a warning")
+		filterExpr  = flag.String("jobs-filter-expr", "", "A CEL expression that jobs must match to be propagated, e.g. job.status == 'Failed' && job.app_id != 'test-app'")
+		eventSource = flag.Bool("enable-event-sourcing", false, "Record every propagation state change as an event in job_propagation_events")
+		deadLetters = flag.Bool("enable-dead-letters", true, "Record jobs that use up all of their attempts in job_propagation_dead_letters and list them at /admin/dead-letters on port 60000. The table is created by --enable-automatic-schema-migration.")
+		wireLogging = flag.Bool("enable-wire-logging", false, "Log the DNS, connect, TLS handshake, and server processing times of apps service requests at the debug level")
+		maxWireLogs = flag.Int64("max-wire-log-entries", 10, "The maximum number of requests logged by --enable-wire-logging in each propagation pass")
+		connReuse   = flag.Bool("enable-connection-reuse", false, "Track whether connections to the apps service are reused and warn when too few of them are")
+		reuseWarnAt = flag.Float64("connection-reuse-warning-threshold", 50, "The percentage of new connections in a pass above which --enable-connection-reuse logs a warning")
+		bodyHash    = flag.Bool("request-body-hash", false, "Log the SHA256 hash of each request body sent to the apps service, and only log the body itself at the debug level")
+		autoMigrate = flag.Bool("enable-automatic-schema-migration", false, "Create or update the tables owned by this service at startup. Only one replica migrates at a time.")
+		retryReset  = flag.Duration("job-retry-reset-interval", 0, "Reset the propagation attempts of jobs last attempted longer ago than this, e.g. 24h, so they're retried. Zero disables the reset.")
+		errBudget   = flag.Float64("error-budget", 0.5, "Pause propagation when more than this fraction (0.0-1.0) of the propagations in --error-budget-window fail. Zero disables the pause.")
+		budgetWin   = flag.Duration("error-budget-window", 5*time.Minute, "The rolling window used to calculate the error rate for --error-budget")
+		errorPause  = flag.Duration("error-pause-duration", 30*time.Second, "How long to pause propagation when the error budget is exhausted")
+		traceConns  = flag.Bool("trace-db-connections", false, "Add OTEL spans around the database calls that wait for a connection from the pool")
+		idPattern   = flag.String("job-id-regex", ".*", "A regular expression that external IDs must match in their entirety to be propagated")
+		appsMethod  = flag.String("apps-callback-method", http.MethodPost, "The HTTP method used to send updates to the apps service: POST, PUT, or PATCH")
+		dbFailover  = flag.String("db-failover-uris", "", "Comma-separated database URIs to fail over to, in order, when the primary database is unreachable")
+		primaryPing = flag.Duration("db-primary-check-interval", 30*time.Second, "How often to check whether the primary database has recovered after a failover")
+		promPush    = flag.Bool("enable-prom-push", false, "Push all metrics to a Prometheus Pushgateway when the service exits, e.g. after a --once run")
+		pushURL     = flag.String("prom-pushgateway-url", "", "The URL of the Prometheus Pushgateway used by --enable-prom-push")
+		pushJob     = flag.String("prom-push-job-name", serviceName, "The job label for metrics pushed to the Pushgateway")
+		pushInst    = flag.String("prom-push-instance", "", "The instance label for metrics pushed to the Pushgateway. Defaults to the hostname.")
+		stmtCache   = flag.Int("db-query-cache-size", 16, "The maximum number of prepared statements to keep for repeated queries")
+		noPrepare   = flag.Bool("disable-prepared-statements", false, "Send the full query text every time instead of using prepared statements, e.g. for PgBouncer in transaction mode")
+		fromStdin   = flag.Bool("jobs-from-stdin", false, "Propagate the newline-separated job UUIDs read from stdin instead of querying the database, then exit")
+		logReqIDs   = flag.Bool("log-request-ids", false, "Log the X-Request-ID header of each apps service response at the debug level")
+		initConc    = flag.Int("initial-concurrency", 0, "Adapt the number of concurrent propagations to the apps service's capacity, starting at this many. Zero uses --workers.")
+		failPct     = flag.Float64("failure-threshold-pct", 20, "The percentage of failed propagations in a batch that halves the adaptive concurrency")
+		honorBP     = flag.Bool("enable-backpressure-signaling", false, "Honor X-Backpressure response headers from the apps service: pause-<duration> pauses propagation and slow-down halves the --initial-concurrency limit")
+		initCheck   = flag.Bool("initial-propagation-check", false, "Check that the job_status_updates table exists and log whether it has any rows before the first pass")
+		roundTrip   = flag.Bool("apps-uri-round-trip-test", false, "Send a test update for the all-zeroes job UUID to the apps service at startup and log the round-trip latency")
+		structErrs  = flag.Bool("enable-structured-errors", false, "Log propagation failures with structured error fields: code, message, uuid, and timestamp")
+		pollEvery   = flag.Duration("poll-interval", 5*time.Second, "How long to wait between propagation passes. Defaults to apps.poll_interval in the config file if it's set there.")
+		onStartup   = flag.Bool("propagate-on-startup", true, "Run the first propagation pass immediately instead of waiting for the poll interval")
+		spanBatch   = flag.Bool("enable-span-processor-batch", false, "Configure the batch span processor that exports OTEL spans with --otel-batch-size and --otel-batch-timeout instead of the OTEL_BSP_* environment variables")
+		otelBatch   = flag.Int("otel-batch-size", 512, "The maximum number of spans in each OTEL export batch")
+		otelTimeout = flag.Duration("otel-batch-timeout", 5*time.Second, "The longest a span waits before it's exported")
+		maskApps    = flag.Bool("apps-uri-masking", true, "Replace the values of the --sensitive-params query parameters in apps URIs with *** when they're logged")
+		sensParams  = flag.String("sensitive-params", "token,key,secret,password", "The comma-separated names of the apps URI query parameters masked by --apps-uri-masking")
+		logLevel    = flag.String("log-level", "info", "The minimum level of log entries to write: trace, debug, info, warn, error, fatal, or panic. Debug logging includes SQL statements, apps service request and response headers, and the jobs in each batch. Defaults to logging.level in the config file if it's set there.")
+		logFormat   = flag.String("log-format", "text", "The format of log entries: text or json")
+		stagingTbl  = flag.Bool("enable-staging-table", false, "Claim pending jobs in the jobs_to_propagate table before propagating them, so that replicas don't propagate the same jobs. The table is created by --enable-automatic-schema-migration.")
+		metricsPort = flag.Int("metrics-port", 9090, "The port that serves the /metrics endpoint. Use 60000 to serve it alongside the other endpoints.")
+		preflight   = flag.String("pre-flight-sql", "", "A SQL statement to run before looking up the pending jobs in each pass, e.g. REFRESH MATERIALIZED VIEW job_summary. Failures are logged and don't stop the pass.")
+		workers     = flag.Int("workers", 10, "The number of worker goroutines that propagate jobs concurrently")
+		postflight  = flag.String("post-flight-sql", "", "A SQL statement to run after each propagation pass, e.g. to clean up old rows. Failures are logged and don't stop the service.")
+		transRetry  = flag.Int("transient-retries", 0, "The number of times to retry a 5xx, 429, or network error from the apps service before counting the attempt as failed. Zero disables these retries.")
+		backoffBase = flag.Duration("backoff-base-delay", 100*time.Millisecond, "The delay before the first --transient-retries retry")
+		backoffMax  = flag.Duration("backoff-max-delay", 5*time.Second, "The longest delay between --transient-retries retries")
+		backoffMult = flag.Float64("backoff-multiplier", 2, "The factor applied to the delay after each --transient-retries retry")
+		appsGroups  = flag.String("apps-uris", "", "Comma-separated group:uri pairs, e.g. primary:http://apps1/callbacks,backup:http://apps2/callbacks. Each update goes to the first URI that accepts it; backup URIs are only tried after the primary ones fail.")
+		dedupe      = flag.Bool("enable-request-deduplication", false, "Check the apps service's {callbacks URI}/{uuid}/status?update_id={id} endpoint before sending each status update and skip the updates it already processed")
+		healthQuery = flag.String("health-check-db-query", "SELECT 1 FROM job_status_updates LIMIT 1", "The SQL query run by the health checks to make sure the database is usable. An empty query only pings the database.")
+		promNS      = flag.String("prom-namespace", "cyverse", "The namespace prepended to the names of the service's Prometheus metrics")
+		promSub     = flag.String("prom-subsystem", "job_status_adapter", "The subsystem prepended to the names of the service's Prometheus metrics, after the namespace")
+		cbThreshold = flag.Int("circuit-breaker-threshold", 0, "Stop sending updates to an apps URI after this many consecutive 5xx, 429, or network errors within --circuit-breaker-window. Zero disables the circuit breaker.")
+		cbWindow    = flag.Duration("circuit-breaker-window", time.Minute, "How far back failures are counted by --circuit-breaker-threshold")
+		cbCoolDown  = flag.Duration("circuit-breaker-cool-down", 30*time.Second, "How long to stop sending updates to an apps URI once its circuit breaker opens")
+		traceFmt    = flag.String("tracing-propagation-format", "w3c", "The trace context headers sent to the apps service: w3c, b3 (single header), or b3multi")
+		maxOpen     = flag.Int("db-max-open-conns", 25, "The maximum number of open database connections. Zero means no limit. Defaults to db.max_open_conns in the config file if it's set there.")
+		maxIdle     = flag.Int("db-max-idle-conns", 10, "The maximum number of idle database connections. Defaults to db.max_idle_conns in the config file if it's set there.")
+		maxLifetime = flag.Duration("db-conn-max-lifetime", 5*time.Minute, "The longest a database connection is reused. Zero means no limit. Defaults to db.conn_max_lifetime in the config file if it's set there.")
+		awsSecretID = flag.String("aws-secret-id", "", "The ID of an AWS Secrets Manager secret holding a JSON object with config settings, merged over the config file")
+		awsRegion   = flag.String("aws-region", "", "The AWS region of --aws-secret-id. Defaults to the region in the environment.")
+		vaultAddr   = flag.String("vault-addr", "", "The address of the Vault server holding --vault-secret-path. Defaults to VAULT_ADDR.")
+		vaultToken  = flag.String("vault-token", "", "The token used to read --vault-secret-path, renewed in the background while the service runs. Defaults to VAULT_TOKEN.")
+		vaultPath   = flag.String("vault-secret-path", "", "The path of a Vault secret with config settings, e.g. secret/data/job-status-to-apps-adapter, merged over the config file")
+		fanParallel = flag.Bool("fanout-parallel", false, "Send each update to all of the apps URIs at once instead of one after the other")
+		fanRequire  = flag.Bool("fanout-require-all", true, "Only count an update as propagated if every apps URI accepts it. If false, one URI accepting it is enough.")
+		transport   = flag.String("transport", "http", "How job status updates are propagated: http sends them to the apps service and amqp publishes them to --amqp-exchange")
+		amqpExch    = flag.String("amqp-exchange", "", "The exchange that --transport amqp publishes to. Defaults to amqp.exchange.name in the config file.")
+		amqpKey     = flag.String("amqp-routing-key", "jobs.status-updates", "The routing key of the messages published by --transport amqp")
+		watchDNS    = flag.Bool("watch-apps-uri-dns", false, "Resolve the apps URI hosts before each batch and reconnect to the apps service if their addresses changed")
+		idleTxTime  = flag.Duration("db-idle-in-transaction-timeout", 0, "Set idle_in_transaction_session_timeout in the transactions that look up, claim, and expire jobs so that Postgres ends them if they're left idle for this long, e.g. 10s. It doesn't apply to the transaction that reads the pending jobs from a cursor, which stays open while the jobs are propagated. Zero disables the timeout.")
+		compress    = flag.Bool("enable-compression-middleware", false, "Gzip the bodies of requests to the apps service that are at least --compression-min-size bytes. Can't be used with --signing-key.")
+		compressMin = flag.Int("compression-min-size", 512, "The smallest request body, in bytes, that --enable-compression-middleware compresses")
+		authToken   = flag.String("apps-auth-token", "", "The token sent with every request to the apps service. Defaults to apps.auth_token in the config file. Never logged.")
+		authHeader  = flag.String("apps-auth-header", "Authorization", "The header that carries --apps-auth-token. The token is sent as a bearer token in the Authorization header and as it is in any other header, e.g. X-API-Key.")
+		maxRespBody = flag.Int64("max-response-body", maxErrorBody, "The number of bytes of an apps service error response body included in the error that's logged")
+		batchTime   = flag.Duration("batch-timeout", 0, "The maximum amount of time a single batch of jobs may take. Propagations still running when it expires are cancelled and count as failed attempts. Zero disables the timeout.")
+		signingKey  = flag.String("signing-key", "", "The hex-encoded key used to sign request bodies with HMAC-SHA256 in the X-Signature header. Defaults to apps.signing_key in the config file. Requests aren't signed without a key.")
+		checkpointF = flag.String("checkpoint-file", "", "A file that records the jobs in the batch being propagated. Jobs left in it by a crash are propagated first on the next start.")
+		dryRun      = flag.Bool("dry-run", false, "Look up the jobs to propagate and log the requests that would be sent, without sending them or writing anything to the database. Options that write to the database or the checkpoint file are rejected.")
+		gcInterval  = flag.Duration("gc-interval", 0, "Force a garbage collection after passes of more than --gc-trigger-count jobs, at most once per interval. Zero disables it.")
+		gcTrigger   = flag.Int("gc-trigger-count", 1000, "The number of jobs a pass must exceed before --gc-interval forces a garbage collection")
+		jobLocks    = flag.Bool("enable-job-locks", false, "Hold a Postgres advisory lock on each job while it's propagated so that replicas skip jobs another replica is propagating. Each concurrent propagation uses a second database connection, so --db-max-open-conns must exceed the maximum concurrency, plus one more for the snapshot cursor.")
+		memLimit    = flag.String("mem-limit", "", "Pause new propagations while the heap is over this size, e.g. 500MB, until it drops below --mem-low-watermark. Empty disables it.")
+		memLowWater = flag.String("mem-low-watermark", "", "The heap size below which propagation resumes after going over --mem-limit. Defaults to 80% of --mem-limit.")
+		memCheck    = flag.Duration("mem-check-interval", time.Second, "How often the heap size is checked against --mem-limit")
+		maxAge      = flag.Duration("max-age", 0, "Give up on jobs whose unpropagated status updates were all sent longer ago than this, e.g. 168h, writing them to the dead letters table if it's enabled. Zero disables it.")
+		pendingAPI  = flag.Bool("enable-pending-endpoint", false, "List the jobs waiting to be propagated at /api/v1/pending on port 60000")
+		healthAPI   = flag.Bool("enable-health-endpoints", true, "Serve the /healthz and /readyz Kubernetes probes on port 60000")
+		passTimeout = flag.Duration("propagation-timeout-total", 10*time.Minute, "The maximum amount of time a single propagation pass may take")
+		httpTimeout = flag.Duration("http-timeout", 30*time.Second, "The maximum amount of time a request to the apps service may take. Zero disables the timeout.")
+		http2Mode   = flag.String("http2-enabled", "auto", "Whether to use HTTP/2 with the apps service: auto, true (including cleartext HTTP/2), or false")
+		err         error
+		cfg         *viper.Viper
+		db          *sql.DB
+		appsURI     string
+	)
+
+	flag.Parse()
+
+	level, err := logrus.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Printf("Error: --log-level: %s\n", err)
+		os.Exit(-1)
+	}
+	log.Logger.SetLevel(level)
+
+	switch *logFormat {
+	case "text":
+	case "json":
+		log.Logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		fmt.Printf("Error: --log-format must be text or json, not %s\n", *logFormat)
+		os.Exit(-1)
+	}
+
+	SensitiveParams = nil
+	if *maskApps {
+		for _, name := range strings.Split(*sensParams, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				SensitiveParams = append(SensitiveParams, name)
+			}
+		}
+	}
+
+	// rootCtx is canceled when the service is asked to shut down.
+	rootCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	var tracerCtx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	if *spanBatch {
+		opts := BatchOptions{MaxExportBatchSize: *otelBatch, BatchTimeout: *otelTimeout}
+		if err := opts.SetEnv(); err != nil {
+			log.Error(err)
+		}
+	}
+	shutdown := otelutils.TracerProviderFromEnv(tracerCtx, serviceName, func(e error) { log.Error(e) })
+	defer shutdown()
+
+	textMapPropagator, err := TextMapPropagator(*traceFmt)
+	if err != nil {
+		fmt.Printf("Error: --tracing-propagation-format: %s\n", err)
+		os.Exit(-1)
+	}
+	otel.SetTextMapPropagator(textMapPropagator)
+
+	if *showVersion {
+		version.AppVersion()
+		os.Exit(0)
+	}
+
+	if *cfgPath == "" {
+		fmt.Println("Error: --config must be set.")
+		flag.PrintDefaults()
+		os.Exit(-1)
+	}
+
+	if *sampleRate < 0.0 || *sampleRate > 1.0 {
+		fmt.Println("Error: --jobs-sample-rate must be between 0.0 and 1.0.")
+		os.Exit(-1)
+	}
+
+	if *transRetry < 0 || *backoffBase < 0 || *backoffMax < 0 || *backoffMult < 1 {
+		fmt.Println("Error: --transient-retries and the backoff delays must not be negative, and --backoff-multiplier must be at least 1.")
+		os.Exit(-1)
+	}
+
+	if *cbThreshold < 0 {
+		fmt.Println("Error: --circuit-breaker-threshold must not be negative.")
+		os.Exit(-1)
+	}
+
+	if *workers < 1 {
+		fmt.Println("Error: --workers must be at least 1.")
+		os.Exit(-1)
+	}
+
+	if *errBudget < 0.0 || *errBudget > 1.0 {
+		fmt.Println("Error: --error-budget must be between 0.0 and 1.0.")
+		os.Exit(-1)
+	}
+
+	if *errBudget > 0 && *budgetWin <= 0 {
+		fmt.Println("Error: --error-budget-window must be positive.")
+		os.Exit(-1)
+	}
+
+	if *sampleSeed == 0 {
+		*sampleSeed = time.Now().UnixNano()
+	}
+	sampler := rand.New(rand.NewSource(*sampleSeed))
+	shuffler := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	retryOnCodes, err := ParseStatusCodes(*retryOn)
+	if err != nil {
+		fmt.Printf("Error: --retry-on-status-codes: %s\n", err)
+		os.Exit(-1)
+	}
+
+	noRetryOnCodes, err := ParseStatusCodes(*noRetryOn)
+	if err != nil {
+		fmt.Printf("Error: --no-retry-on-status-codes: %s\n", err)
+		os.Exit(-1)
+	}
+
+	retryPolicy := &RetryPolicy{RetryOn: retryOnCodes, NoRetryOn: noRetryOnCodes}
+
+	method, err := ParseCallbackMethod(*appsMethod)
+	if err != nil {
+		fmt.Printf("Error: --apps-callback-method: %s\n", err)
+		os.Exit(-1)
+	}
+
+	jobIDRegex, err := CompileJobIDRegex(*idPattern)
+	if err != nil {
+		fmt.Printf("Error: --job-id-regex: %s\n", err)
+		os.Exit(-1)
+	}
+
+	var jobFilter *JobFilter
+	if *filterExpr != "" {
+		jobFilter, err = NewJobFilter(*filterExpr)
+		if err != nil {
+			fmt.Printf("Error: --jobs-filter-expr: %s\n", err)
+			os.Exit(-1)
+		}
+	}
+
+	if *cpuProfile {
+		f, err := os.Create(*profilePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+
+		if err = pprof.StartCPUProfile(f); err != nil {
+			log.Fatal(err)
+		}
+		defer pprof.StopCPUProfile()
+		log.Infof("Writing a CPU profile to %s", *profilePath)
+	}
+
+	metadata := &InstanceMetadata{}
+	if *metadataURL != "" {
+		metadata = FetchInstanceMetadata(rootCtx, *metadataURL)
+		log = log.WithFields(metadata.Fields())
+	}
+
+	metricsReg := prometheus.WrapRegistererWithPrefix(
+		metricPrefix(*promNS, *promSub),
+		prometheus.WrapRegistererWith(metadata.Labels(), prometheus.DefaultRegisterer),
+	)
+	if err = registerMetrics(metricsReg); err != nil {
+		log.Fatal(err)
+	}
+
+	if *promPush {
+		if *pushURL == "" {
+			fmt.Println("Error: --prom-pushgateway-url is required with --enable-prom-push.")
+			os.Exit(-1)
+		}
+		if *pushInst == "" {
+			*pushInst, _ = os.Hostname()
+		}
+		pushMetrics := sync.OnceFunc(func() {
+			log.Infof("Pushing metrics to %s", *pushURL)
+			if err := PushMetrics(*pushURL, *pushJob, *pushInst, prometheus.DefaultGatherer); err != nil {
+				log.Errorf("Error pushing metrics to %s: %s", *pushURL, err)
+			}
+		})
+		defer pushMetrics()
+		// log.Fatal exits without running deferred calls, so the metrics are
+		// pushed by logrus before it exits too.
+		logrus.RegisterExitHandler(pushMetrics)
+	}
+
+	cfg, err = configurate.InitDefaults(*cfgPath, configurate.JobServicesDefaults)
+	if err != nil {
+		log.Error(err)
+		os.Exit(-1)
+	}
+
+	if *awsSecretID != "" {
+		log.Infof("Reading config from AWS secret %s", *awsSecretID)
+		client, err := NewSecretsManagerClient(context.Background(), *awsRegion)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = MergeAWSSecret(context.Background(), client, *awsSecretID, cfg); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *vaultPath != "" {
+		log.Infof("Reading config from the Vault secret at %s", *vaultPath)
+		client, err := NewVaultClient(*vaultAddr, *vaultToken)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = MergeVaultSecret(rootCtx, client, *vaultPath, cfg); err != nil {
+			log.Fatal(err)
+		}
+		go RenewVaultToken(rootCtx, client)
+	}
+
+	log.Info("Done reading config.")
+
+	if *dbURI == "" {
+		*dbURI = cfg.GetString("db.uri")
+	} else {
+		cfg.Set("db.uri", *dbURI)
+	}
+
+	if *dumpConfig {
+		if err = DumpConfig(os.Stdout, cfg.AllSettings()); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	appsURI = cfg.GetString("apps.callbacks_uri")
+	callbackURIs := cfg.GetStringSlice("apps.callbacks_uris")
+	if len(callbackURIs) > 0 {
+		appsURI = callbackURIs[0]
+	}
+
+	// Settings that can also come from the config file only use it if the
+	// flag wasn't set on the command line.
+	setFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	if !setFlags["log-level"] && cfg.IsSet("logging.level") {
+		level, err := logrus.ParseLevel(cfg.GetString("logging.level"))
+		if err != nil {
+			fmt.Printf("Error: logging.level: %s\n", err)
+			os.Exit(-1)
+		}
+		log.Logger.SetLevel(level)
+	}
+	if !setFlags["poll-interval"] && cfg.IsSet("apps.poll_interval") {
+		*pollEvery = cfg.GetDuration("apps.poll_interval")
+	}
+	if *pollEvery <= 0 {
+		fmt.Println("Error: the poll interval must be greater than zero.")
+		os.Exit(-1)
+	}
+
+	if !setFlags["apps-auth-token"] {
+		*authToken = cfg.GetString("apps.auth_token")
+	}
+	if *authToken != "" {
+		log.Logger.AddHook(NewRedactionHook(*authToken))
+	}
+
+	if !setFlags["signing-key"] {
+		*signingKey = cfg.GetString("apps.signing_key")
+	}
+	var signingKeyBytes []byte
+	if *signingKey != "" {
+		if signingKeyBytes, err = hex.DecodeString(*signingKey); err != nil {
+			fmt.Printf("Error: --signing-key must be hex-encoded: %s\n", err)
+			os.Exit(-1)
+		}
+		// The signature covers the uncompressed body, so it wouldn't match the
+		// gzipped body that the apps service receives.
+		if *compress {
+			fmt.Println("Error: --signing-key can't be used with --enable-compression-middleware")
+			os.Exit(-1)
+		}
+		log.Logger.AddHook(NewRedactionHook(*signingKey))
+		log.Infof("Signing requests to the apps service in the %s header", SignatureHeader)
+	}
+
+	if !setFlags["db-max-open-conns"] && cfg.IsSet("db.max_open_conns") {
+		*maxOpen = cfg.GetInt("db.max_open_conns")
+	}
+	if !setFlags["db-max-idle-conns"] && cfg.IsSet("db.max_idle_conns") {
+		*maxIdle = cfg.GetInt("db.max_idle_conns")
+	}
+	if !setFlags["db-conn-max-lifetime"] && cfg.IsSet("db.conn_max_lifetime") {
+		*maxLifetime = cfg.GetDuration("db.conn_max_lifetime")
+	}
+
+	if *transport != "http" && *transport != "amqp" {
+		fmt.Printf("Error: --transport must be http or amqp, not %s\n", *transport)
+		os.Exit(-1)
+	}
+
+	if *dryRun {
+		// A dry run must not change the database or the checkpoint file, so
+		// the options that write to them can't be used with it.
+		for _, opt := range []struct {
+			name string
+			set  bool
+		}{
+			{"pre-flight-sql", *preflight != ""},
+			{"post-flight-sql", *postflight != ""},
+			{"enable-staging-table", *stagingTbl},
+			{"enable-job-locks", *jobLocks},
+			{"job-retry-reset-interval", *retryReset > 0},
+			{"enable-automatic-schema-migration", *autoMigrate},
+			{"checkpoint-file", *checkpointF != ""},
+		} {
+			if opt.set {
+				fmt.Printf("Error: --%s can't be used with --dry-run\n", opt.name)
+				os.Exit(-1)
+			}
+		}
+	}
+
+	if *jobLocks && *maxOpen > 0 {
+		// Each concurrent propagation holds a connection for its lock, one
+		// more is needed to record the results, and another for the cursor.
+		maxConc := *workers
+		if *initConc > 0 {
+			maxConc = *batchSize
+		}
+		needed := maxConc + 1
+		if *snapshotMin > 0 && !*fromStdin && !*stagingTbl {
+			needed++
+		}
+		if *maxOpen < needed {
+			fmt.Printf("Error: --db-max-open-conns must be at least %d with --enable-job-locks\n", needed)
+			os.Exit(-1)
+		}
+	}
+
+	var memGate *MemoryGate
+	if *memLimit != "" {
+		limit, err := ParseByteSize(*memLimit)
+		if err != nil || limit == 0 {
+			fmt.Printf("Error: --mem-limit must be a positive size, e.g. 500MB\n")
+			os.Exit(-1)
+		}
+		low := limit / 5 * 4
+		if *memLowWater != "" {
+			if low, err = ParseByteSize(*memLowWater); err != nil || low >= limit {
+				fmt.Printf("Error: --mem-low-watermark must be a size below --mem-limit\n")
+				os.Exit(-1)
+			}
+		}
+		if *memCheck <= 0 {
+			fmt.Println("Error: --mem-check-interval must be positive")
+			os.Exit(-1)
+		}
+		memGate = NewMemoryGate(limit, low, *memCheck)
+	}
+
+	if *maxAge < 0 {
+		fmt.Println("Error: --max-age must not be negative")
+		os.Exit(-1)
+	}
+
+	if *batchTime < 0 {
+		fmt.Println("Error: --batch-timeout must not be negative")
+		os.Exit(-1)
+	}
+
+	if *idleTxTime < 0 {
+		fmt.Println("Error: --db-idle-in-transaction-timeout must not be negative")
+		os.Exit(-1)
+	}
+
+	if !*keepAlive {
+		log.Info("HTTP keep-alives disabled; each request to the apps service will open a new connection")
+		appsTransport.DisableKeepAlives = true
+	}
+
+	if *httpTimeout < 0 {
+		fmt.Println("Error: --http-timeout must not be negative.")
+		os.Exit(-1)
+	}
+	appsTransport.ResponseHeaderTimeout = *httpTimeout
+	httpClient.Timeout = *httpTimeout
+
+	var appsCAs *x509.CertPool
+	if *tlsCA != "" {
+		if appsCAs, err = LoadCAPool(*tlsCA); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Verifying the apps service's certificate with the CAs in %s", *tlsCA)
+	}
+
+	newAppsRoundTripper := func(tlsConfig *tls.Config) (http.RoundTripper, error) {
+		if appsCAs != nil {
+			if tlsConfig == nil {
+				tlsConfig = &tls.Config{}
+			}
+			tlsConfig.RootCAs = appsCAs
+		}
+		t := appsTransport.Clone()
+		t.TLSClientConfig = tlsConfig
+		return ConfigureHTTP2(t, *http2Mode)
+	}
+
+	// rebuildApps replaces the transport used for the apps service so that new
+	// requests open new connections.
+	var rebuildApps func() error
+	var appsRoundTripper http.RoundTripper
+	if *tlsCert != "" || *tlsKey != "" {
+		rotator, err := NewCertificateRotator(*tlsCert, *tlsKey, newAppsRoundTripper)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := rotator.Watch(rootCtx); err != nil {
+				log.Errorf("Unable to watch the apps client certificate for changes: %s", err)
+			}
+		}()
+		appsRoundTripper = rotator
+		rebuildApps = rotator.Reload
+	} else {
+		rebuilder, err := NewRebuildingRoundTripper(func() (http.RoundTripper, error) {
+			return newAppsRoundTripper(nil)
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		appsRoundTripper = rebuilder
+		rebuildApps = rebuilder.Rebuild
+	}
+	if log.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		appsRoundTripper = NewHeaderLogRoundTripper(appsRoundTripper, *authHeader)
+	}
+	if *authToken != "" {
+		log.Infof("Sending the apps service auth token in the %s header", *authHeader)
+		appsRoundTripper = NewAuthRoundTripper(appsRoundTripper, *authHeader, *authToken)
+	}
+	if *compress {
+		log.Infof("Compressing request bodies of at least %d bytes", *compressMin)
+		appsRoundTripper = NewCompressingRoundTripper(appsRoundTripper, *compressMin)
+	}
+	httpClient.Transport = otelhttp.NewTransport(appsRoundTripper)
+
+	if !*redirects {
+		httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+
+	log.Infof("Connecting to the database at %s...", MaskDBURI(*dbURI))
+	// The connectors that wrap lib/pq's are registered as their own driver so
+	// that dbutil retries the connection the same way for all of them.
+	dbDriver := "postgres"
+	logQueries := log.Logger.IsLevelEnabled(logrus.DebugLevel)
+	if *dbFailover != "" || logQueries {
+		var connector driver.Connector
+		if *dbFailover != "" {
+			dbURIs := []string{*dbURI}
+			for _, uri := range strings.Split(*dbFailover, ",") {
+				if uri = strings.TrimSpace(uri); uri != "" {
+					dbURIs = append(dbURIs, uri)
+				}
+			}
+
+			failover, err := NewFailoverConnector(dbURIs)
+			if err != nil {
+				log.Fatal(err)
+			}
+			go failover.WatchPrimary(rootCtx, *primaryPing)
+			connector = failover
+		} else {
+			connector, err = pq.NewConnector(*dbURI)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if logQueries {
+			connector = NewQueryLogConnector(connector)
+		}
+		dbDriver = serviceName + "-postgres"
+		sql.Register(dbDriver, NewConnectorDriver(connector))
+	}
+
+	dbConnector, err := dbutil.NewDefaultConnector("1m")
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err = dbConnector.Connect(dbDriver, *dbURI)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db.SetMaxOpenConns(*maxOpen)
+	db.SetMaxIdleConns(*maxIdle)
+	db.SetConnMaxLifetime(*maxLifetime)
+	log.Infof("Database pool: at most %d open and %d idle connections, each used for up to %s", *maxOpen, *maxIdle, *maxLifetime)
+	if *idleTxTime > 0 {
+		log.Infof("Transactions that look up jobs will be ended by the database if they're left idle for %s", *idleTxTime)
+	}
+
+	if err = db.Ping(); err != nil {
+		log.Fatal(err)
+	}
+	log.Info("Connected to the database")
+
+	if *autoMigrate {
+		log.Info("Migrating the database schema")
+		if err = Migrate(rootCtx, db); err != nil {
+			log.Fatal(err)
+		}
+		log.Info("Done migrating the database schema")
+	}
+
+	if *grpcHealth {
+		go func() {
+			if err := ServeGRPCHealth(rootCtx, db, *grpcPort, *healthQuery); err != nil {
+				log.Errorf("The gRPC health server failed: %s", err)
+				stop()
+			}
+		}()
+	}
+
+	propagatorOpts := &PropagatorOptions{
+		Method:               method,
+		IdempotencyKeyHeader: *idemHeader,
+		BodyHash:             *bodyHash,
+		LogRequestIDs:        *logReqIDs,
+		StructuredErrors:     *structErrs,
+		RequestTimeout:       *httpTimeout,
+		Deduplicate:          *dedupe,
+		MaxResponseBody:      *maxRespBody,
+		SigningKey:           signingKeyBytes,
+		CircuitBreaker: CircuitBreakerSettings{
+			Threshold: *cbThreshold,
+			Window:    *cbWindow,
+			CoolDown:  *cbCoolDown,
+		},
+	}
+	if *wireLogging {
+		propagatorOpts.WireLogger = NewWireLogger(*maxWireLogs)
+	}
+	if *connReuse {
+		propagatorOpts.ReuseTracker = &ConnectionReuseTracker{}
+	}
+
+	if *urisFile != "" && *appsGroups != "" {
+		log.Fatal("--apps-uris-file and --apps-uris can't be used together")
+	}
+
+	appsURIs := []string{appsURI}
+	if len(callbackURIs) > 0 {
+		appsURIs = callbackURIs
+	}
+	if *urisFile != "" {
+		appsURIs, err = ReadAppsURIs(*urisFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var uriGroups []URIGroup
+	if *appsGroups != "" {
+		uriGroups, err = ParseURIGroups(*appsGroups)
+		if err != nil {
+			log.Fatal(err)
+		}
+		appsURIs = nil
+		for _, g := range uriGroups {
+			appsURIs = append(appsURIs, g.URIs...)
+		}
+	}
+
+	if *checkApps {
+		for _, uri := range appsURIs {
+			err = CheckAppsVersion(rootCtx, &httpClient, uri, *minApps)
+			if err != nil && *strictApps {
+				log.Fatal(err)
+			}
+			if err != nil {
+				log.Warn(err)
+			}
+		}
+	}
+
+	if *roundTrip {
+		for _, uri := range appsURIs {
+			latency, status, err := MeasureAppsRoundTrip(rootCtx, &httpClient, uri, method, signingKeyBytes)
+			if err != nil {
+				log.Warnf("Round-trip test to %s failed: %s", MaskAppsURI(uri), err)
+				continue
+			}
+			log.Infof("Round-trip test to %s took %s (%s)", MaskAppsURI(uri), latency, status)
+		}
+	}
+
+	var dnsWatcher *DNSWatcher
+	if *watchDNS {
+		if dnsWatcher, err = NewDNSWatcher(appsURIs); err != nil {
+			log.Fatal(err)
+		}
+		dnsWatcher.Changed(rootCtx)
+	}
+
+	var proper JobPropagator
+	var dryRunner *DryRunPropagator
+	if *dryRun {
+		log.Warn("Dry run: job status updates will be logged instead of propagated")
+		dryRunner = NewDryRunPropagator(db, method, appsURIs)
+		proper = dryRunner
+	} else if *transport == "amqp" {
+		if *amqpExch == "" {
+			*amqpExch = cfg.GetString("amqp.exchange.name")
+		}
+		log.Infof("Publishing job status updates to the %s exchange with the routing key %s", *amqpExch, *amqpKey)
+		amqpPropagator, err := NewAMQPPropagator(db, cfg.GetString("amqp.uri"), *amqpExch, *amqpKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer amqpPropagator.Close()
+		proper = amqpPropagator
+	} else if len(uriGroups) > 0 {
+		for _, g := range uriGroups {
+			log.Infof("Apps URI group %s has %d URIs", g.Name, len(g.URIs))
+		}
+		proper, err = NewMultiAppsURIPropagator(db, uriGroups, propagatorOpts)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if len(appsURIs) > 1 {
+		log.Infof("Propagating job status updates to %d apps URIs", len(appsURIs))
+		multi, err := NewMultiDBPropagator(db, appsURIs, propagatorOpts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		multi.Parallel = *fanParallel
+		multi.RequireAll = *fanRequire
+		proper = multi
+	} else {
+		proper, err = NewPropagator(db, appsURIs[0], propagatorOpts)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *transRetry > 0 {
+		proper = NewRetryingPropagator(proper, Backoff{
+			Retries:    *transRetry,
+			BaseDelay:  *backoffBase,
+			MaxDelay:   *backoffMax,
+			Multiplier: *backoffMult,
+		})
+	}
+
+	var claimOwner string
+	if *stagingTbl {
+		if claimOwner, err = os.Hostname(); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Claiming jobs in the jobs_to_propagate table as %s", claimOwner)
+		proper = NewStagingTablePropagator(db, proper)
+	}
+
+	if *jobLocks {
+		log.Info("Locking each job while it's propagated")
+		proper = NewLockingPropagator(db, proper)
+	}
+
+	if *retryReset > 0 {
+		go ResetRetriesPeriodically(rootCtx, db, *retryReset)
+	}
+
+	if *poolStats > 0 {
+		go MonitorDBPool(rootCtx, db, *poolStats)
+	}
+
+	var metricsServer *http.Server
+	if *metricsOn && *metricsPort == 60000 {
+		http.Handle("/metrics", promhttp.Handler())
+	} else if *metricsOn {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		metricsServer = &http.Server{Addr: fmt.Sprintf("0.0.0.0:%d", *metricsPort), Handler: mux}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Errorf("The metrics server failed: %s", err)
+				stop()
+			}
+		}()
+	} else {
+		log.Info("Metrics endpoint disabled")
+	}
+
+	if *deadLetters {
+		http.Handle("/admin/dead-letters", DeadLettersHandler(db))
+	}
+
+	jobQuery := &JobQuery{
+		MaxRetries:      *maxRetries,
+		DefaultPriority: *defPriority,
+		MaxAge:          *maxAge,
+	}
+	expiry := &ExpiryQuery{
+		MaxAge:      *maxAge,
+		MaxRetries:  *maxRetries,
+		SkipClaimed: *stagingTbl,
+		SkipLocked:  *jobLocks,
+	}
+	for _, jobType := range strings.Split(*jobTypes, ",") {
+		if jobType = strings.TrimSpace(jobType); jobType != "" {
+			jobQuery.JobTypes = append(jobQuery.JobTypes, jobType)
+		}
+	}
+	if !*noPrepare && *stmtCache > 0 {
+		jobQuery.Stmts = NewStmtCache(db, *stmtCache)
+		defer jobQuery.Stmts.Close()
+	}
+	if len(jobQuery.JobTypes) > 0 {
+		log.Infof("Only propagating status updates for job types: %s", strings.Join(jobQuery.JobTypes, ", "))
+	}
+
+	if *pendingAPI {
+		http.Handle("/api/v1/pending", PendingJobsHandler(db, jobQuery))
+	}
+
+	// firstPass is set once the propagation loop has finished a pass, which
+	// /readyz waits for.
+	var firstPass atomic.Bool
+	if *healthAPI {
+		http.Handle("/healthz", HealthzHandler())
+		http.Handle("/readyz", ReadyzHandler(db, *healthQuery, &firstPass))
+	}
+
+	// Port 60000 is only opened if at least one endpoint is served on it.
+	var server *http.Server
+	if *healthAPI || *pendingAPI || *deadLetters || (*metricsOn && *metricsPort == 60000) {
+		server = &http.Server{Addr: "0.0.0.0:60000"}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Errorf("The HTTP server failed: %s", err)
+				stop()
+			}
+		}()
+	}
+
+	stats := &PropagationStats{}
+	dumper := NewDebugDumper(*dumpPath, stats)
+
+	var gc *GCTrigger
+	if *gcInterval > 0 {
+		gc = NewGCTrigger(*gcInterval, *gcTrigger)
+	}
+
+	if memGate != nil {
+		go memGate.Run(rootCtx)
+	}
+
+	var checkpoint *Checkpoint
+	var recovered []string
+	if *checkpointF != "" {
+		checkpoint = NewCheckpoint(*checkpointF)
+		if recovered, err = checkpoint.Load(); err != nil {
+			log.Errorf("Unable to read the checkpoint file %s: %s", *checkpointF, err)
+		}
+		if len(recovered) > 0 {
+			log.WithField("jobs", recovered).Warnf("%d jobs were in progress when the service last stopped; propagating them first", len(recovered))
+		}
+	}
+	go dumper.DumpOnSignal(rootCtx)
+
+	timeouts := Timeouts{Statement: *stmtTimeout, Lock: *lockTimeout, IdleInTransaction: *idleTxTime}
+
+	// The cursor's transaction sits idle while each batch is propagated.
+	cursorTimeouts := timeouts
+	cursorTimeouts.IdleInTransaction = 0
+
+	// loopDB is used for the queries that look up pending jobs.
+	var loopDB interface {
+		DBTX
+		TxBeginner
+	} = db
+	if *traceConns {
+		loopDB = &TracedDB{db}
+	}
+
+	if *initCheck {
+		exists, err := HasJobStatusUpdates(rootCtx, db)
+		if err != nil {
+			log.Fatalf("Unable to query the job_status_updates table; check that the service is connected to the DE database: %s", err)
+		}
+		if exists {
+			log.Info("Found job status updates in the database")
+		} else {
+			log.Info("No jobs found in database, will poll for new ones")
+		}
+	}
+
+	var stdinJobs []string
+	if *fromStdin {
+		stdinJobs, err = ReadJobIDs(os.Stdin)
+		if err != nil {
+			log.Fatalf("Error reading job IDs from stdin: %s", err)
+		}
+		log.Infof("Read %d job IDs from stdin", len(stdinJobs))
+	}
+
+	var aimd *AIMDConcurrencyController
+	if *initConc > 0 {
+		aimd = NewAIMDConcurrencyController(*initConc, *batchSize, *failPct)
+	}
+
+	backpressure := &PauseGate{}
+	if *honorBP {
+		propagatorOpts.OnBackpressure = func(signal Backpressure) {
+			if signal.Pause > 0 {
+				backpressure.PauseFor(signal.Pause)
+			}
+			if signal.SlowDown && aimd != nil {
+				aimd.Decrease()
+			}
+		}
+	}
+
+	var events *EventStore
+	if *eventSource && !*dryRun {
+		log.Info("Recording propagation events in job_propagation_events")
+		events = NewEventStore(db)
+	}
+
+	handler := &jobHandler{
+		db:             db,
+		maxRetries:     *maxRetries,
+		propagator:     proper,
+		retryPolicy:    retryPolicy,
+		stats:          stats,
+		traceFailures:  *traceFails,
+		maxStackFrames: *maxFrames,
+		deadLetters:    *deadLetters,
+		events:         events,
+		dryRun:         *dryRun,
+	}
+	if *errBudget > 0 {
+		handler.errorBudget = NewErrorBudget(*errBudget, *budgetWin, *errorPause)
+	}
+
+	log.Infof("Polling for unpropagated job status updates every %s", *pollEvery)
+	ticker := time.NewTicker(*pollEvery)
+	defer ticker.Stop()
+
+	for pass := 0; ; pass++ {
+		waitForPass(rootCtx, pass, *onStartup, ticker.C)
+		if rootCtx.Err() != nil {
+			log.Info("Shutting down")
+			break
+		}
+
+		// The pass isn't cancelled when the service is asked to shut down, so
+		// the propagations that are already running can finish and record
+		// their outcomes. Only jobs that haven't started are left behind.
+		batchID := uuid.New().String()
+		ctx, span := otel.Tracer(otelName).Start(
+			WithBatchID(context.WithoutCancel(rootCtx), batchID),
+			"propagation loop",
+			trace.WithAttributes(attribute.String("batch_id", batchID)),
+		)
+		log := loggerFromContext(ctx)
+
+		if propagatorOpts.WireLogger != nil {
+			propagatorOpts.WireLogger.Reset()
+		}
+		if propagatorOpts.ReuseTracker != nil {
+			propagatorOpts.ReuseTracker.Reset()
+		}
+
+		if *preflight != "" && !*fromStdin {
+			if err := ExecInTx(ctx, loopDB, timeouts, *preflight); err != nil {
+				log.Warnf("Error running the pre-flight SQL: %s", err)
+			}
+		}
+
+		if *maxAge > 0 && !*dryRun {
+			if err := handler.expire(ctx, loopDB, timeouts, expiry); err != nil {
+				log.Errorf("Error giving up on jobs older than --max-age: %s", err)
+			}
+		}
+
+		if *queryPlan && log.Logger.IsLevelEnabled(logrus.DebugLevel) {
+			plan, err := ExplainUnpropagated(ctx, loopDB, jobQuery)
+			if err != nil {
+				log.Errorf("Error explaining the unpropagated jobs query: %s", err)
+			} else {
+				log.WithField("query_plan", plan).Debug("Unpropagated jobs query plan")
+			}
+		}
+
+		var (
+			retried map[string]int64
+			pending int
+		)
+		err = InTx(ctx, loopDB, timeouts, func(tx *sql.Tx) error {
+			var err error
+			if retried, err = RetriedJobs(ctx, tx, *maxRetries); err != nil {
+				return err
+			}
+			if *snapshotMin > 0 {
+				pending, err = CountUnpropagated(ctx, tx, jobQuery)
+			}
+			return err
+		})
+		if errors.Is(err, ErrLockTimeout) {
+			log.Warnf("Skipping this pass: %s", err)
+			span.End()
+			continue
+		}
+		if err != nil {
+			span.End()
+			log.Fatal(err)
+		}
+		budget := NewRetryBudget(*retryBudget)
+
+		// prepare samples and shuffles the pending jobs as requested and
+		// records them for the debug dump.
+		prepare := func(jobs []string) []string {
+			if *sampleRate < 1.0 {
+				total := len(jobs)
+				jobs = SampleJobs(jobs, *sampleRate, sampler)
+				log.Debugf("Sampled %d of %d unpropagated jobs", len(jobs), total)
+			}
+			if *randomize {
+				shuffler.Shuffle(len(jobs), func(i, j int) {
+					jobs[i], jobs[j] = jobs[j], jobs[i]
+				})
+			}
+			dumper.SetPending(jobs, retried)
+			return jobs
+		}
+
+		passCtx, passCancel := context.WithTimeout(ctx, *passTimeout)
+		passJobs := 0
+
+		runBatch := func(batch []string) {
+			// The addresses are checked before each batch so that a long
+			// pass doesn't keep using the old ones. No propagations are
+			// running between batches, so the connections can be replaced.
+			if dnsWatcher != nil && dnsWatcher.Changed(ctx) {
+				if err := rebuildApps(); err != nil {
+					log.Errorf("Unable to reconnect to the apps service after its addresses changed: %s", err)
+				} else {
+					log.Info("Reconnecting to the apps service after its addresses changed")
+				}
+			}
+
+			dumper.SetBatch(batch)
+			defer dumper.SetBatch(nil)
+			passJobs += len(batch)
+			if err := checkpoint.Save(batch); err != nil {
+				log.Errorf("Unable to write the checkpoint file: %s", err)
+			}
+			jobPropagationBatchSize.Set(float64(len(batch)))
+
+			// The number of workers bounds the number of goroutines and
+			// connections to the apps service.
+			limit := *workers
+			if aimd != nil {
+				limit = aimd.Limit()
+			}
+			log.WithField("jobs", batch).Debugf("Propagating a batch of %d jobs, up to %d at a time", len(batch), limit)
+			succeeded, failed := stats.Succeeded.Load(), stats.Failed.Load()
+
+			pool := NewConcurrentPropagator(limit, func(ctx context.Context, jobExtID string) {
+				// Waiting to start a job stops when the service shuts down.
+				waitCtx, waitCancel := context.WithCancel(ctx)
+				defer waitCancel()
+				defer context.AfterFunc(rootCtx, waitCancel)()
+
+				if handler.errorBudget != nil {
+					if err := handler.errorBudget.Wait(waitCtx); err != nil {
+						return
+					}
+				}
+				if err := backpressure.Wait(waitCtx); err != nil {
+					return
+				}
+				if err := memGate.Wait(waitCtx); err != nil {
+					return
+				}
+				if rootCtx.Err() != nil {
+					return
+				}
+
+				if *validateID && !ValidExternalID(ctx, jobExtID) {
+					return
+				}
+
+				if !jobIDRegex.MatchString(jobExtID) {
+					log.Warnf("Skipping job with external ID %q because it doesn't match --job-id-regex", jobExtID)
+					return
+				}
+
+				if jobFilter != nil {
+					job, err := LookupJobDetails(ctx, db, jobExtID)
+					if err != nil {
+						log.Errorf("Error looking up the details of job %s: %s", jobExtID, err)
+						return
+					}
+					matched, err := jobFilter.Match(job)
+					if err != nil {
+						log.Error(err)
+						return
+					}
+					if !matched {
+						log.Debugf("Skipping job %s because it doesn't match --jobs-filter-expr", jobExtID)
+						return
+					}
+				}
+
+				handler.handle(ctx, jobExtID, retried[jobExtID], budget)
+			})
+
+			// A batch that hangs is cancelled so that it can't hold up the
+			// batches after it.
+			batchCtx := passCtx
+			if *batchTime > 0 {
+				var batchCancel context.CancelFunc
+				batchCtx, batchCancel = context.WithTimeout(passCtx, *batchTime)
+				defer batchCancel()
+			}
+			pool.Run(batchCtx, batch)
+			if errors.Is(batchCtx.Err(), context.DeadlineExceeded) && passCtx.Err() == nil {
+				log.Warnf("Batch of %d jobs timed out after %s; unfinished jobs will be picked up on the next pass", len(batch), *batchTime)
+			}
+			if batchCtx.Err() == nil && rootCtx.Err() == nil {
+				if err := checkpoint.Remove(); err != nil {
+					log.Errorf("Unable to remove the checkpoint file: %s", err)
+				}
+			}
+
+			if aimd != nil {
+				aimd.Update(stats.Succeeded.Load()-succeeded, stats.Failed.Load()-failed)
+			}
+		}
+
+		if len(recovered) > 0 {
+			// The recovered jobs are checked the same way as the pending jobs,
+			// so that the ones that were propagated, ran out of attempts, or
+			// were claimed by another replica since the crash are skipped.
+			recoveredQuery := *jobQuery
+			recoveredQuery.ExternalIDs, recoveredQuery.Stmts = recovered, nil
+			var jobs []string
+			if *stagingTbl {
+				jobs, err = ClaimJobs(ctx, loopDB, timeouts, &recoveredQuery, claimOwner, time.Now().Add(-*passTimeout))
+			} else {
+				err = InTx(ctx, loopDB, timeouts, func(tx *sql.Tx) error {
+					var err error
+					jobs, err = Unpropagated(ctx, tx, &recoveredQuery)
+					return err
+				})
+			}
+			if err != nil {
+				log.Errorf("Unable to look up the jobs from the checkpoint file; leaving them to the regular query: %s", err)
+			} else if len(jobs) > 0 {
+				runBatch(jobs)
+			}
+			recovered = nil
+		}
+
+		if *snapshotMin > 0 && pending > *snapshotMin && !*fromStdin && !*stagingTbl {
+			log.Infof("%d jobs are waiting to be propagated; reading them from a cursor", pending)
+			err = InTx(passCtx, loopDB, cursorTimeouts, func(tx *sql.Tx) error {
+				return ForEachUnpropagatedBatch(passCtx, tx, jobQuery, *batchSize, func(batch []string) error {
+					runBatch(prepare(batch))
+					if rootCtx.Err() != nil {
+						return rootCtx.Err()
+					}
+					return passCtx.Err()
+				})
+			})
+			if err != nil && passCtx.Err() == nil && rootCtx.Err() == nil {
+				log.Error(err)
+			}
+		} else {
+			var batches [][]string
+
+			var unpropped []string
+			if *fromStdin {
+				unpropped, err = stdinJobs, nil
+			} else if *stagingTbl {
+				unpropped, err = ClaimJobs(ctx, loopDB, timeouts, jobQuery, claimOwner, time.Now().Add(-*passTimeout))
+			} else {
+				err = InTx(ctx, loopDB, timeouts, func(tx *sql.Tx) error {
+					var err error
+					unpropped, err = Unpropagated(ctx, tx, jobQuery)
+					return err
+				})
+			}
+			if errors.Is(err, ErrLockTimeout) {
+				log.Warnf("Skipping this pass: %s", err)
+				passCancel()
+				span.End()
+				continue
+			}
+			if err != nil {
+				passCancel()
+				span.End()
+				log.Fatal(err)
+			}
+			unpropped = prepare(unpropped)
+
+			for *batchSize < len(unpropped) {
+				unpropped, batches = unpropped[*batchSize:], append(batches, unpropped[0:*batchSize])
+			}
+			batches = append(batches, unpropped)
+
+			for _, batch := range batches {
+				if passCtx.Err() != nil || rootCtx.Err() != nil {
+					break
+				}
+				runBatch(batch)
+			}
+		}
+
+		if budget.Exhausted() {
+			log.Infof("Retry budget of %d exhausted; remaining retries were deferred to the next pass", *retryBudget)
+		}
+
+		if *stagingTbl {
+			released, err := ReleaseClaims(ctx, db, claimOwner)
+			if err != nil {
+				log.Errorf("Error releasing the claims left over from this pass: %s", err)
+			} else if released > 0 {
+				log.Debugf("Released %d claims on jobs that weren't propagated in this pass", released)
+			}
+		}
+
+		if propagatorOpts.ReuseTracker != nil {
+			ratio, total := propagatorOpts.ReuseTracker.Ratio()
+			connectionReuseRatio.Set(ratio)
+			if total > 0 && (1-ratio)*100 > *reuseWarnAt {
+				log.Warnf("%.0f%% of the %d connections to the apps service in this pass were new; the batch size or keep-alive timeout may need adjustment", (1-ratio)*100, total)
+			}
+		}
+
+		if *postflight != "" && !*fromStdin {
+			if err := ExecInTx(ctx, loopDB, timeouts, *postflight); err != nil {
+				log.Warnf("Error running the post-flight SQL: %s", err)
+			}
+		}
+
+		if errors.Is(passCtx.Err(), context.DeadlineExceeded) {
+			log.Warnf("Propagation pass timed out after %s; remaining jobs will be picked up on the next pass", *passTimeout)
+		}
+		passCancel()
+		firstPass.Store(true)
+		gc.AfterPass(passJobs)
+		if dryRunner != nil {
+			log.Infof("Dry run: would propagate %d jobs", dryRunner.Reset())
+		}
+
+		span.End()
+
+		if *once || *fromStdin {
+			break
+		}
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	if server != nil {
+		if err = server.Shutdown(shutdownCtx); err != nil {
+			log.Errorf("Error shutting down the HTTP server: %s", err)
+		}
+	}
+	if metricsServer != nil {
+		if err = metricsServer.Shutdown(shutdownCtx); err != nil {
+			log.Errorf("Error shutting down the metrics server: %s", err)
+		}
 	}
 }
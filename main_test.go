@@ -1,17 +1,33 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	sqlmock "github.com/DATA-DOG/go-sqlmock"
 	"github.com/cyverse-de/configurate"
+	"github.com/lib/pq"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -26,6 +42,28 @@ func inittests(t *testing.T) {
 	}
 }
 
+// expectUpdates sets up the mock to return a status update with each of the
+// IDs when the job's unpropagated status updates are looked up.
+func expectUpdates(mock sqlmock.Sqlmock, externalID string, ids ...string) {
+	rows := sqlmock.NewRows([]string{"id", "status", "sent_on"})
+	for i, id := range ids {
+		rows.AddRow(id, "Running", int64(1000+i))
+	}
+	mock.ExpectQuery("select id, status, sent_on").
+		WithArgs(externalID).
+		WillReturnRows(rows)
+}
+
+// expectMarked expects the status update with the ID to be marked as
+// propagated in its own transaction.
+func expectMarked(mock sqlmock.Sqlmock, id string) {
+	mock.ExpectBegin()
+	mock.ExpectExec("set propagated = 'true'").
+		WithArgs(id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
 func TestUnpropagated(t *testing.T) {
 	inittests(t)
 
@@ -36,11 +74,11 @@ func TestUnpropagated(t *testing.T) {
 	defer db.Close()
 
 	rows := sqlmock.NewRows([]string{"external_id"}).AddRow("1")
-	mock.ExpectQuery("select distinct external_id").
-		WithArgs(1).
+	mock.ExpectQuery("select u.external_id").
+		WithArgs(1, 5).
 		WillReturnRows(rows)
 
-	_, err = Unpropagated(context.Background(), db, 1)
+	_, err = Unpropagated(context.Background(), db, &JobQuery{MaxRetries: 1, DefaultPriority: 5})
 	if err != nil {
 		t.Errorf("error calling Unpropagated: %s", err)
 	}
@@ -50,6 +88,156 @@ func TestUnpropagated(t *testing.T) {
 	}
 }
 
+func TestJobQuerySQL(t *testing.T) {
+	q := &JobQuery{MaxRetries: 3, DefaultPriority: 5}
+	queryStr, args := q.SQL()
+	if strings.Contains(queryStr, "job_types") {
+		t.Error("query without job types should not join to job_types")
+	}
+	if len(args) != 2 {
+		t.Errorf("query had %d arguments instead of 2", len(args))
+	}
+
+	q.JobTypes = []string{"DE", "Interactive"}
+	queryStr, args = q.SQL()
+	if !strings.Contains(queryStr, "join job_types") || !strings.Contains(queryStr, "t.name = any($3)") {
+		t.Errorf("query did not filter on job types: %s", queryStr)
+	}
+	if len(args) != 3 {
+		t.Errorf("query had %d arguments instead of 3", len(args))
+	}
+
+	q.MaxAge = 168 * time.Hour
+	queryStr, args = q.SQL()
+
+	// sent_on is in epoch milliseconds, so it can't be compared with a
+	// timestamp. The age is applied to each job rather than to each update.
+	cutoff := "having max(u.sent_on) > (extract(epoch from now() - $4::interval) * 1000)::bigint"
+	if !strings.Contains(queryStr, cutoff) {
+		t.Errorf("query did not filter on the maximum age: %s", queryStr)
+	}
+	if strings.Contains(queryStr, "and u.sent_on") {
+		t.Errorf("query filtered individual status updates on their age: %s", queryStr)
+	}
+	if len(args) != 4 || args[3] != "604800000 milliseconds" {
+		t.Errorf("query had the wrong arguments: %v", args)
+	}
+
+	q.ExternalIDs = []string{"job-1", "job-2"}
+	queryStr, args = q.SQL()
+	if !strings.Contains(queryStr, "and u.external_id = any($4)") || !strings.Contains(queryStr, "$5::interval") {
+		t.Errorf("query did not filter on the external IDs: %s", queryStr)
+	}
+	if len(args) != 5 {
+		t.Errorf("query had %d arguments instead of 5", len(args))
+	}
+}
+
+func TestExpiryQuerySQL(t *testing.T) {
+	q := &ExpiryQuery{MaxAge: time.Hour, MaxRetries: 3}
+	queryStr, args := q.SQL()
+	if !strings.Contains(queryStr, "having max(sent_on) <= (extract(epoch from now() - $1::interval) * 1000)::bigint") {
+		t.Errorf("query did not compare sent_on with epoch milliseconds: %s", queryStr)
+	}
+	if strings.Contains(queryStr, "jobs_to_propagate") || strings.Contains(queryStr, "pg_try_advisory") {
+		t.Errorf("query skipped claimed or locked jobs when it shouldn't have: %s", queryStr)
+	}
+	if len(args) != 2 || args[0] != "3600000 milliseconds" || args[1] != int64(3) {
+		t.Errorf("query had the wrong arguments: %v", args)
+	}
+
+	q.SkipClaimed, q.SkipLocked = true, true
+	queryStr, _ = q.SQL()
+	if !strings.Contains(queryStr, "external_id not in (select external_id from jobs_to_propagate)") {
+		t.Errorf("query did not skip claimed jobs: %s", queryStr)
+	}
+	if !strings.Contains(queryStr, ") as expired\n\t where pg_try_advisory_xact_lock(hashtext(external_id))") {
+		t.Errorf("query did not skip locked jobs: %s", queryStr)
+	}
+}
+
+func TestHandlerExpire(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("having max\\(sent_on\\) <= \\(extract\\(epoch from now\\(\\) - \\$1::interval\\) \\* 1000\\)::bigint").
+		WithArgs("3600000 milliseconds", 3).
+		WillReturnRows(sqlmock.NewRows([]string{"external_id"}).AddRow("job-1").AddRow("job-2"))
+	mock.ExpectExec("insert into job_propagation_dead_letters").
+		WithArgs("job-1", "the status updates are older than the maximum age of 1h0m0s").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("insert into job_propagation_dead_letters").
+		WithArgs("job-2", "the status updates are older than the maximum age of 1h0m0s").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("update job_status_updates").
+		WithArgs(pq.Array([]string{"job-1", "job-2"}), 3).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+
+	h := &jobHandler{db: db, maxRetries: 3, stats: &PropagationStats{}, deadLetters: true}
+	if err = h.expire(context.Background(), db, Timeouts{}, &ExpiryQuery{MaxAge: time.Hour, MaxRetries: 3}); err != nil {
+		t.Fatalf("error from expire(): %s", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestHandlerExpireRollsBack(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("select external_id").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id"}).AddRow("job-1"))
+	mock.ExpectExec("insert into job_propagation_dead_letters").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("update job_status_updates").
+		WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	// The dead letter is rolled back with the failed update, so the next pass
+	// doesn't write it again.
+	h := &jobHandler{db: db, maxRetries: 3, stats: &PropagationStats{}, deadLetters: true}
+	if err = h.expire(context.Background(), db, Timeouts{}, &ExpiryQuery{MaxAge: time.Hour, MaxRetries: 3}); err == nil {
+		t.Error("expire() didn't return the error from the update")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestHandlerExpireNothing(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("select external_id").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id"}))
+	mock.ExpectCommit()
+
+	h := &jobHandler{db: db, maxRetries: 3, stats: &PropagationStats{}, deadLetters: true}
+	if err = h.expire(context.Background(), db, Timeouts{}, &ExpiryQuery{MaxAge: time.Hour, MaxRetries: 3}); err != nil {
+		t.Fatalf("error from expire(): %s", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
 func TestNewPropagator(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -57,7 +245,7 @@ func TestNewPropagator(t *testing.T) {
 	}
 	defer db.Close()
 
-	p, err := NewPropagator(db, "uri")
+	p, err := NewPropagator(db, "uri", nil)
 	if err != nil {
 		t.Errorf("error calling NewPropagator(): %s", err)
 	}
@@ -92,7 +280,7 @@ func TestPropagate(t *testing.T) {
 	}))
 	defer server.Close()
 
-	p, err := NewPropagator(db, server.URL)
+	p, err := NewPropagator(db, server.URL, nil)
 	if err != nil {
 		t.Errorf("error calling NewPropagator(): %s", err)
 	}
@@ -101,11 +289,18 @@ func TestPropagate(t *testing.T) {
 		t.Errorf("unfulfilled expectations from NewPropagator()")
 	}
 
+	expectUpdates(mock, "external-id", "update-1")
+	expectMarked(mock, "update-1")
+
 	err = p.Propagate(context.Background(), "external-id")
 	if err != nil {
 		t.Errorf("error from Propagate(): %s", err)
 	}
 
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("the job wasn't marked as propagated: %s", err)
+	}
+
 	actual := &JobStatusUpdate{}
 	if err = json.Unmarshal(body, actual); err != nil {
 		t.Errorf("error unmarshalling body: %s", err)
@@ -115,3 +310,921 @@ func TestPropagate(t *testing.T) {
 		t.Errorf("uuid field was %s instead of %s", actual.UUID, "external-id")
 	}
 }
+
+func TestPropagateBadResponse(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such job", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	expectUpdates(mock, "external-id", "update-1")
+
+	p, err := NewPropagator(db, server.URL, nil)
+	if err != nil {
+		t.Errorf("error calling NewPropagator(): %s", err)
+	}
+
+	err = p.Propagate(context.Background(), "external-id")
+	if err == nil {
+		t.Fatal("expected an error from Propagate()")
+	}
+
+	if !strings.Contains(err.Error(), "no such job") {
+		t.Errorf("error '%s' did not include the response body", err)
+	}
+}
+
+func TestReadErrorBodyGzip(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte("compressed failure")); err != nil {
+		t.Fatalf("error compressing body: %s", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("error closing gzip writer: %s", err)
+	}
+
+	resp := &http.Response{
+		Header: http.Header{"Content-Encoding": []string{"gzip"}},
+		Body:   io.NopCloser(&buf),
+	}
+
+	body, err := readErrorBody(resp, maxErrorBody)
+	if err != nil {
+		t.Fatalf("error calling readErrorBody(): %s", err)
+	}
+
+	if body != "compressed failure" {
+		t.Errorf("body was '%s' instead of 'compressed failure'", body)
+	}
+}
+
+func TestReadErrorBodyLimit(t *testing.T) {
+	resp := &http.Response{Body: io.NopCloser(strings.NewReader("truncated failure"))}
+
+	body, err := readErrorBody(resp, 9)
+	if err != nil {
+		t.Fatalf("error calling readErrorBody(): %s", err)
+	}
+
+	if body != "truncated" {
+		t.Errorf("body was '%s' instead of 'truncated'", body)
+	}
+}
+
+func TestSampleJobs(t *testing.T) {
+	jobs := []string{"1", "2", "3", "4", "5", "6", "7", "8"}
+	rng := rand.New(rand.NewSource(1))
+
+	if actual := SampleJobs(jobs, 1.0, rng); len(actual) != len(jobs) {
+		t.Errorf("sampling at 1.0 returned %d jobs instead of %d", len(actual), len(jobs))
+	}
+
+	if actual := SampleJobs(jobs, 0.0, rng); len(actual) != 0 {
+		t.Errorf("sampling at 0.0 returned %d jobs instead of 0", len(actual))
+	}
+
+	first := SampleJobs(jobs, 0.5, rand.New(rand.NewSource(42)))
+	second := SampleJobs(jobs, 0.5, rand.New(rand.NewSource(42)))
+	if strings.Join(first, ",") != strings.Join(second, ",") {
+		t.Errorf("sampling with the same seed returned %v and %v", first, second)
+	}
+}
+
+func TestExhaustAttempts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("update job_status_updates").
+		WithArgs("external-id", 3).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	if err = ExhaustAttempts(context.Background(), db, "external-id", 3); err != nil {
+		t.Errorf("error calling ExhaustAttempts(): %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations in ExhaustAttempts()")
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	codes, err := ParseStatusCodes("500, 502,503")
+	if err != nil {
+		t.Fatalf("error calling ParseStatusCodes(): %s", err)
+	}
+
+	rp := &RetryPolicy{RetryOn: codes}
+	if !rp.Retryable(502) {
+		t.Error("502 should be retryable")
+	}
+	if rp.Retryable(400) {
+		t.Error("400 should not be retryable")
+	}
+
+	rp = &RetryPolicy{}
+	if !rp.Retryable(400) {
+		t.Error("400 should be retryable with an empty policy")
+	}
+
+	rp = &RetryPolicy{NoRetryOn: map[int]bool{404: true}}
+	if rp.Retryable(404) {
+		t.Error("404 should not be retryable")
+	}
+	if !rp.Retryable(500) {
+		t.Error("500 should be retryable")
+	}
+
+	if _, err = ParseStatusCodes("500,abc"); err == nil {
+		t.Error("expected an error parsing an invalid status code")
+	}
+}
+
+func TestExplainUnpropagated(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{"QUERY PLAN"}).AddRow(`[{"Plan": {}}]`)
+	mock.ExpectQuery("explain \\(analyze, format json\\)").
+		WithArgs(3, 5).
+		WillReturnRows(rows)
+
+	plan, err := ExplainUnpropagated(context.Background(), db, &JobQuery{MaxRetries: 3, DefaultPriority: 5})
+	if err != nil {
+		t.Errorf("error calling ExplainUnpropagated(): %s", err)
+	}
+
+	if plan != `[{"Plan": {}}]` {
+		t.Errorf("unexpected query plan: %s", plan)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations in ExplainUnpropagated()")
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := NewRetryBudget(2)
+	if !budget.Take() || !budget.Take() {
+		t.Error("the first two attempts should fit in the budget")
+	}
+	if budget.Exhausted() {
+		t.Error("budget should not be exhausted yet")
+	}
+	if budget.Take() {
+		t.Error("the third attempt should not fit in the budget")
+	}
+	if !budget.Exhausted() {
+		t.Error("budget should be exhausted")
+	}
+
+	unlimited := NewRetryBudget(0)
+	for i := 0; i < 10; i++ {
+		if !unlimited.Take() {
+			t.Fatal("an unlimited budget should never run out")
+		}
+	}
+}
+
+func TestRetriedJobs(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{"external_id", "max"}).AddRow("1", 1).AddRow("2", 2)
+	mock.ExpectQuery("propagation_attempts > 0").
+		WithArgs(3).
+		WillReturnRows(rows)
+
+	retried, err := RetriedJobs(context.Background(), db, 3)
+	if err != nil {
+		t.Errorf("error calling RetriedJobs(): %s", err)
+	}
+
+	if retried["1"] != 1 || retried["2"] != 2 || len(retried) != 2 {
+		t.Errorf("unexpected retried jobs: %v", retried)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations in RetriedJobs()")
+	}
+}
+
+func TestCountUnpropagated(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("select count\\(\\*\\) from").
+		WithArgs(3, 5).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(42))
+
+	count, err := CountUnpropagated(context.Background(), db, &JobQuery{MaxRetries: 3, DefaultPriority: 5})
+	if err != nil {
+		t.Errorf("error calling CountUnpropagated(): %s", err)
+	}
+
+	if count != 42 {
+		t.Errorf("count was %d instead of 42", count)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations in CountUnpropagated()")
+	}
+}
+
+func TestForEachUnpropagatedBatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("declare unpropagated_jobs no scroll cursor for").
+		WithArgs(3, 5).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("fetch forward 2 from unpropagated_jobs").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id"}).AddRow("1").AddRow("2"))
+	mock.ExpectQuery("fetch forward 2 from unpropagated_jobs").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id"}).AddRow("3"))
+	mock.ExpectQuery("fetch forward 2 from unpropagated_jobs").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id"}))
+
+	var batches [][]string
+	err = ForEachUnpropagatedBatch(context.Background(), db, &JobQuery{MaxRetries: 3, DefaultPriority: 5}, 2, func(batch []string) error {
+		batches = append(batches, batch)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("error calling ForEachUnpropagatedBatch(): %s", err)
+	}
+
+	if len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 1 {
+		t.Errorf("unexpected batches: %v", batches)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations in ForEachUnpropagatedBatch(): %s", err)
+	}
+}
+
+func TestInTx(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("set local statement_timeout = 30000").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select u.external_id").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id"}).AddRow("1"))
+	mock.ExpectCommit()
+
+	var jobs []string
+	err = InTx(context.Background(), db, Timeouts{Statement: 30 * time.Second}, func(tx *sql.Tx) error {
+		var err error
+		jobs, err = Unpropagated(context.Background(), tx, &JobQuery{MaxRetries: 3, DefaultPriority: 5})
+		return err
+	})
+	if err != nil {
+		t.Errorf("error calling InTx(): %s", err)
+	}
+
+	if len(jobs) != 1 {
+		t.Errorf("got %d jobs instead of 1", len(jobs))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations in InTx(): %s", err)
+	}
+}
+
+func TestInTxIdleInTransactionTimeout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	// The timeout only applies to the transaction, not the whole session.
+	mock.ExpectBegin()
+	mock.ExpectExec("set local idle_in_transaction_session_timeout = 10000").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	err = InTx(context.Background(), db, Timeouts{IdleInTransaction: 10 * time.Second}, func(tx *sql.Tx) error {
+		return nil
+	})
+	if err != nil {
+		t.Errorf("error calling InTx(): %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations in InTx(): %s", err)
+	}
+}
+
+func TestStackFrames(t *testing.T) {
+	err := pkgerrors.New("failure")
+	frames := stackFrames(err, 1)
+	if len(frames) != 1 {
+		t.Fatalf("got %d frames instead of 1", len(frames))
+	}
+	if !strings.HasPrefix(frames[0], "TestStackFrames (main_test.go:") {
+		t.Errorf("unexpected first frame: %s", frames[0])
+	}
+
+	frames = stackFrames(fmt.Errorf("no stack"), 2)
+	if len(frames) != 2 || !strings.HasPrefix(frames[0], "TestStackFrames") {
+		t.Errorf("unexpected frames for an error without a stack: %v", frames)
+	}
+}
+
+func TestPropagateIdempotencyKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	var key string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key = r.Header.Get("Idempotency-Key")
+	}))
+	defer server.Close()
+
+	expectUpdates(mock, "external-id", "update-1")
+	expectMarked(mock, "update-1")
+
+	p, err := NewPropagator(db, server.URL, &PropagatorOptions{IdempotencyKeyHeader: "Idempotency-Key"})
+	if err != nil {
+		t.Errorf("error calling NewPropagator(): %s", err)
+	}
+
+	if err = p.Propagate(WithAttempt(context.Background(), 2), "external-id"); err != nil {
+		t.Errorf("error from Propagate(): %s", err)
+	}
+
+	if key != "update-1-2" {
+		t.Errorf("idempotency key was '%s' instead of 'update-1-2'", key)
+	}
+}
+
+func TestInTxApplicationName(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	traceID, _ := trace.TraceIDFromHex("0102030405060708090a0b0c0d0e0f10")
+	spanID, _ := trace.SpanIDFromHex("0102030405060708")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID,
+		SpanID:  spanID,
+	}))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("select set_config\\('application_name', \\$1, true\\)").
+		WithArgs("jsta/0102030405060708090a0b0c0d0e0f10/0102030405060708").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	if err = InTx(ctx, db, Timeouts{}, func(tx *sql.Tx) error { return nil }); err != nil {
+		t.Errorf("error calling InTx(): %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations in InTx(): %s", err)
+	}
+}
+
+func TestInTxLockTimeout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("set local lock_timeout = 10000").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select u.external_id").
+		WillReturnError(&pq.Error{Code: "55P03", Message: "canceling statement due to lock timeout"})
+	mock.ExpectRollback()
+
+	err = InTx(context.Background(), db, Timeouts{Lock: 10 * time.Second}, func(tx *sql.Tx) error {
+		_, err := Unpropagated(context.Background(), tx, &JobQuery{MaxRetries: 3, DefaultPriority: 5})
+		return err
+	})
+	if !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("error was '%v' instead of ErrLockTimeout", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations in InTx(): %s", err)
+	}
+}
+
+func TestLoggerFromContext(t *testing.T) {
+	if _, ok := loggerFromContext(context.Background()).Data["batch_id"]; ok {
+		t.Error("expected no batch_id field without a batch ID in the context")
+	}
+
+	entry := loggerFromContext(WithBatchID(context.Background(), "batch-1"))
+	if entry.Data["batch_id"] != "batch-1" {
+		t.Errorf("batch_id field was %v instead of batch-1", entry.Data["batch_id"])
+	}
+}
+
+func TestWithLogFields(t *testing.T) {
+	ctx := WithBatchID(context.Background(), "batch-1")
+	ctx = WithLogFields(ctx, logrus.Fields{"job_id": "job-1"})
+
+	entry := loggerFromContext(ctx)
+	if entry.Data["job_id"] != "job-1" {
+		t.Errorf("job_id field was %v instead of job-1", entry.Data["job_id"])
+	}
+	if entry.Data["batch_id"] != "batch-1" {
+		t.Errorf("batch_id field was %v instead of batch-1", entry.Data["batch_id"])
+	}
+}
+
+func TestPropagateBodyHash(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	hook := logtest.NewLocal(log.Logger)
+	defer log.Logger.ReplaceHooks(make(logrus.LevelHooks))
+
+	expectUpdates(mock, "external-id", "update-1")
+	expectMarked(mock, "update-1")
+
+	p, err := NewPropagator(db, server.URL, &PropagatorOptions{BodyHash: true})
+	if err != nil {
+		t.Errorf("error calling NewPropagator(): %s", err)
+	}
+
+	if err = p.Propagate(context.Background(), "external-id"); err != nil {
+		t.Errorf("error from Propagate(): %s", err)
+	}
+
+	sum := sha256.Sum256([]byte(`{"id":"update-1","uuid":"external-id","status":"Running","sent_on":1000}`))
+	expected := hex.EncodeToString(sum[:])
+
+	var found bool
+	for _, entry := range hook.AllEntries() {
+		if entry.Data["body_sha256"] == expected {
+			found = true
+		}
+		if entry.Level == logrus.InfoLevel && strings.HasPrefix(entry.Message, "Message to propagate") {
+			t.Errorf("the request body was logged at the info level: %s", entry.Message)
+		}
+	}
+	if !found {
+		t.Errorf("no log entry contained body_sha256 %s", expected)
+	}
+}
+
+func TestResetStaleRetries(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	before := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectExec("set propagation_attempts = 0").
+		WithArgs(before.UnixMilli()).
+		WillReturnResult(sqlmock.NewResult(0, 4))
+
+	count, err := ResetStaleRetries(context.Background(), db, before)
+	if err != nil {
+		t.Errorf("error calling ResetStaleRetries(): %s", err)
+	}
+	if count != 4 {
+		t.Errorf("ResetStaleRetries() returned %d instead of 4", count)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations in ResetStaleRetries(): %s", err)
+	}
+}
+
+func TestCompileJobIDRegex(t *testing.T) {
+	re, err := CompileJobIDRegex("[0-9a-f-]{36}|legacy-[0-9]+")
+	if err != nil {
+		t.Fatalf("error calling CompileJobIDRegex(): %s", err)
+	}
+
+	tests := map[string]bool{
+		"1ba8e742-2f8c-4d1a-b4b5-6b2bbb3d3e04": true,
+		"legacy-123":                           true,
+		"legacy-123-extra":                     false,
+		"not-a-job-id":                         false,
+	}
+	for id, expected := range tests {
+		if actual := re.MatchString(id); actual != expected {
+			t.Errorf("MatchString(%q) returned %t instead of %t", id, actual, expected)
+		}
+	}
+
+	if _, err = CompileJobIDRegex("("); err == nil {
+		t.Error("expected an error compiling an invalid pattern")
+	}
+}
+
+func TestParseCallbackMethod(t *testing.T) {
+	for input, expected := range map[string]string{"POST": "POST", "put": "PUT", " Patch ": "PATCH"} {
+		actual, err := ParseCallbackMethod(input)
+		if err != nil {
+			t.Errorf("error parsing %q: %s", input, err)
+		}
+		if actual != expected {
+			t.Errorf("ParseCallbackMethod(%q) returned %q instead of %q", input, actual, expected)
+		}
+	}
+
+	if _, err := ParseCallbackMethod("GET"); err == nil {
+		t.Error("expected an error for GET")
+	}
+}
+
+func TestPropagateMethod(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	var method string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+	}))
+	defer server.Close()
+
+	expectUpdates(mock, "external-id", "update-1")
+	expectMarked(mock, "update-1")
+
+	p, err := NewPropagator(db, server.URL, &PropagatorOptions{Method: http.MethodPut})
+	if err != nil {
+		t.Errorf("error calling NewPropagator(): %s", err)
+	}
+
+	if err = p.Propagate(context.Background(), "external-id"); err != nil {
+		t.Errorf("error from Propagate(): %s", err)
+	}
+
+	if method != http.MethodPut {
+		t.Errorf("method was %s instead of PUT", method)
+	}
+}
+
+func TestReadJobIDs(t *testing.T) {
+	input := "1ba8e742-2f8c-4d1a-b4b5-6b2bbb3d3e04\n\nnot-a-uuid\n  c0d2b4a6-5e0f-4f5d-9a3e-2f4b6d8e0a1c  \n"
+	ids, err := ReadJobIDs(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("error calling ReadJobIDs(): %s", err)
+	}
+
+	expected := []string{"1ba8e742-2f8c-4d1a-b4b5-6b2bbb3d3e04", "c0d2b4a6-5e0f-4f5d-9a3e-2f4b6d8e0a1c"}
+	if strings.Join(ids, ",") != strings.Join(expected, ",") {
+		t.Errorf("ReadJobIDs() returned %v instead of %v", ids, expected)
+	}
+}
+
+func TestValidExternalID(t *testing.T) {
+	hook := logtest.NewLocal(log.Logger)
+	defer log.Logger.ReplaceHooks(make(logrus.LevelHooks))
+
+	before := testutil.ToFloat64(malformedUUIDs)
+	if !ValidExternalID(context.Background(), "1ba8e742-2f8c-4d1a-b4b5-6b2bbb3d3e04") {
+		t.Error("a valid UUID was rejected")
+	}
+	if ValidExternalID(context.Background(), "not-a-uuid") {
+		t.Error("a malformed external ID was accepted")
+	}
+
+	if actual := testutil.ToFloat64(malformedUUIDs) - before; actual != 1 {
+		t.Errorf("malformed_uuid_total went up by %v instead of 1", actual)
+	}
+	if entry := hook.LastEntry(); entry == nil || !strings.Contains(entry.Message, `"not-a-uuid"`) {
+		t.Error("the malformed external ID wasn't logged")
+	}
+}
+
+func TestPropagateLogRequestIDs(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-ID", "apps-request-1")
+	}))
+	defer server.Close()
+
+	hook := logtest.NewLocal(log.Logger)
+	defer log.Logger.ReplaceHooks(make(logrus.LevelHooks))
+
+	level := log.Logger.GetLevel()
+	log.Logger.SetLevel(logrus.DebugLevel)
+	defer log.Logger.SetLevel(level)
+
+	expectUpdates(mock, "external-id", "update-1")
+	expectMarked(mock, "update-1")
+
+	p, err := NewPropagator(db, server.URL, &PropagatorOptions{LogRequestIDs: true})
+	if err != nil {
+		t.Errorf("error calling NewPropagator(): %s", err)
+	}
+
+	if err = p.Propagate(context.Background(), "external-id"); err != nil {
+		t.Errorf("error from Propagate(): %s", err)
+	}
+
+	var found bool
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.DebugLevel && entry.Data["request_id"] == "apps-request-1" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("the apps service request ID wasn't logged")
+	}
+}
+
+func TestHasJobStatusUpdates(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("select exists \\(select 1 from job_status_updates limit 1\\)").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery("select exists").
+		WillReturnError(&pq.Error{Code: "42P01", Message: `relation "job_status_updates" does not exist`})
+
+	exists, err := HasJobStatusUpdates(context.Background(), db)
+	if err != nil {
+		t.Errorf("error calling HasJobStatusUpdates(): %s", err)
+	}
+	if exists {
+		t.Error("HasJobStatusUpdates() returned true for an empty table")
+	}
+
+	if _, err = HasJobStatusUpdates(context.Background(), db); err == nil {
+		t.Error("expected an error for a missing table")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations in HasJobStatusUpdates(): %s", err)
+	}
+}
+
+func TestIncrementAttempts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("set propagation_attempts = propagation_attempts \\+ 1").
+		WithArgs("external-id", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	if err = IncrementAttempts(context.Background(), db, "external-id"); err != nil {
+		t.Errorf("error calling IncrementAttempts(): %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations in IncrementAttempts(): %s", err)
+	}
+}
+
+// blockingPropagator doesn't return until the context is done.
+type blockingPropagator struct{}
+
+func (blockingPropagator) Propagate(ctx context.Context, uuid string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestHandleRecordsAttemptAfterTimeout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	h := &jobHandler{db: db, maxRetries: 3, propagator: blockingPropagator{}, stats: &PropagationStats{}}
+
+	// The attempt is still recorded after the batch times out mid-propagation.
+	mock.ExpectExec("set propagation_attempts = propagation_attempts \\+ 1").
+		WithArgs("job-1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	h.handle(ctx, "job-1", 0, NewRetryBudget(0))
+
+	if actual := h.stats.Failed.Load(); actual != 1 {
+		t.Errorf("recorded %d failures instead of 1", actual)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPropagateRequestTimeout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	expectUpdates(mock, "external-id", "update-1")
+
+	p, err := NewPropagator(db, server.URL, &PropagatorOptions{RequestTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Errorf("error calling NewPropagator(): %s", err)
+	}
+
+	start := time.Now()
+	err = p.Propagate(context.Background(), "external-id")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Propagate() returned %v instead of a deadline error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Propagate() took %s to time out", elapsed)
+	}
+}
+
+func TestExecInTx(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("refresh materialized view job_summary").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	if err = ExecInTx(context.Background(), db, Timeouts{}, "refresh materialized view job_summary"); err != nil {
+		t.Errorf("error calling ExecInTx(): %s", err)
+	}
+
+	execErr := errors.New("relation \"job_summary\" does not exist")
+	mock.ExpectBegin()
+	mock.ExpectExec("refresh materialized view job_summary").WillReturnError(execErr)
+	mock.ExpectRollback()
+
+	if err = ExecInTx(context.Background(), db, Timeouts{}, "refresh materialized view job_summary"); !errors.Is(err, execErr) {
+		t.Errorf("ExecInTx() returned %v instead of %v", err, execErr)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations in ExecInTx(): %s", err)
+	}
+}
+
+func TestUnpropagatedUpdates(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("from job_status_updates\\s+where external_id = \\$1\\s+and propagated = 'false'\\s+order by sent_on asc").
+		WithArgs("external-id").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status", "sent_on"}).
+			AddRow("update-1", "Submitted", int64(1000)).
+			AddRow("update-2", "Running", int64(2000)))
+
+	updates, err := UnpropagatedUpdates(context.Background(), db, "external-id")
+	if err != nil {
+		t.Fatalf("error calling UnpropagatedUpdates(): %s", err)
+	}
+
+	expected := []JobStatusUpdate{
+		{ID: "update-1", UUID: "external-id", Status: "Submitted", SentOn: 1000},
+		{ID: "update-2", UUID: "external-id", Status: "Running", SentOn: 2000},
+	}
+	if !reflect.DeepEqual(updates, expected) {
+		t.Errorf("UnpropagatedUpdates() returned %#v instead of %#v", updates, expected)
+	}
+}
+
+func TestPropagateInOrder(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	var received []JobStatusUpdate
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var jsu JobStatusUpdate
+		if err := json.NewDecoder(r.Body).Decode(&jsu); err != nil {
+			t.Errorf("error decoding the body: %s", err)
+		}
+		received = append(received, jsu)
+		if jsu.ID == "update-3" {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	// The third update fails, so the fourth isn't sent ahead of it.
+	expectUpdates(mock, "external-id", "update-1", "update-2", "update-3", "update-4")
+	expectMarked(mock, "update-1")
+	expectMarked(mock, "update-2")
+
+	p, err := NewPropagator(db, server.URL, nil)
+	if err != nil {
+		t.Fatalf("error calling NewPropagator(): %s", err)
+	}
+	if err = p.Propagate(context.Background(), "external-id"); err == nil {
+		t.Error("expected an error from Propagate() when an update fails")
+	}
+
+	var ids []string
+	for _, jsu := range received {
+		ids = append(ids, jsu.ID)
+	}
+	if expected := []string{"update-1", "update-2", "update-3"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("the apps service received %v instead of %v", ids, expected)
+	}
+	if received[0].Status != "Running" || received[0].UUID != "external-id" {
+		t.Errorf("unexpected update: %#v", received[0])
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestWaitForPass(t *testing.T) {
+	tick := make(chan time.Time, 1)
+	tick <- time.Now()
+
+	// The first pass doesn't wait for a tick with onStartup set.
+	waitForPass(context.Background(), 0, true, tick)
+	if len(tick) != 1 {
+		t.Error("the first pass waited for a tick with onStartup set")
+	}
+
+	waitForPass(context.Background(), 0, false, tick)
+	if len(tick) != 0 {
+		t.Error("the first pass didn't wait for a tick without onStartup")
+	}
+
+	tick <- time.Now()
+	waitForPass(context.Background(), 1, true, tick)
+	if len(tick) != 0 {
+		t.Error("the second pass didn't wait for a tick")
+	}
+
+	// Cancelling the context stops the wait.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	waitForPass(ctx, 1, true, tick)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dsnPassword matches the password in a key=value connection string.
+var dsnPassword = regexp.MustCompile(`(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// MaskDBURI replaces the password in a database URI with ***, so that the URI
+// can be logged. Both URLs and key=value connection strings are supported.
+func MaskDBURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme == "" {
+		return dsnPassword.ReplaceAllString(uri, "${1}***")
+	}
+
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "***")
+	}
+	if q := u.Query(); q.Has("password") {
+		q.Set("password", "***")
+		u.RawQuery = q.Encode()
+	}
+
+	// Avoid escaping the asterisks.
+	masked, err := url.PathUnescape(u.String())
+	if err != nil {
+		return u.String()
+	}
+	return masked
+}
+
+// SensitiveParams lists the names of the query parameters that MaskAppsURI
+// redacts. Names are compared without regard to case.
+var SensitiveParams = []string{"token", "key", "secret", "password"}
+
+// MaskAppsURI replaces the values of the query parameters in SensitiveParams
+// with ***, so that apps URIs carrying API keys can be logged. The URI is
+// returned unchanged if it can't be parsed or has nothing to redact.
+func MaskAppsURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.RawQuery == "" || len(SensitiveParams) == 0 {
+		return uri
+	}
+
+	q := u.Query()
+	masked := false
+	for name := range q {
+		for _, sensitive := range SensitiveParams {
+			if strings.EqualFold(name, sensitive) {
+				q[name] = []string{"***"}
+				masked = true
+				break
+			}
+		}
+	}
+	if !masked {
+		return uri
+	}
+	u.RawQuery = strings.ReplaceAll(q.Encode(), "%2A%2A%2A", "***")
+	return u.String()
+}
+
+// maskURLError masks the apps URI in the *url.Error returned by an
+// http.Client, which includes the full request URL in its message.
+func maskURLError(err error) error {
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		uerr.URL = MaskAppsURI(uerr.URL)
+	}
+	return err
+}
+
+// redactionHook replaces secrets with *** in the messages and string fields of
+// log entries before they're written, so that they can't be logged by
+// accident at any level.
+type redactionHook struct {
+	secrets []string
+}
+
+// NewRedactionHook returns a logrus.Hook that redacts the non-empty secrets.
+func NewRedactionHook(secrets ...string) logrus.Hook {
+	h := &redactionHook{}
+	for _, secret := range secrets {
+		if secret != "" {
+			h.secrets = append(h.secrets, secret)
+		}
+	}
+	return h
+}
+
+func (h *redactionHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *redactionHook) Fire(entry *logrus.Entry) error {
+	for _, secret := range h.secrets {
+		entry.Message = strings.ReplaceAll(entry.Message, secret, "***")
+		for k, v := range entry.Data {
+			if s, ok := v.(string); ok {
+				entry.Data[k] = strings.ReplaceAll(s, secret, "***")
+			}
+		}
+	}
+	return nil
+}
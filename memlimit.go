@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// byteUnits are the suffixes accepted by ParseByteSize, longest first so that
+// "MiB" isn't mistaken for "B".
+var byteUnits = []struct {
+	suffix string
+	size   uint64
+}{
+	{"KiB", 1 << 10},
+	{"MiB", 1 << 20},
+	{"GiB", 1 << 30},
+	{"KB", 1000},
+	{"MB", 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+// ParseByteSize parses a size such as "500MB" or "512MiB". KB, MB, and GB are
+// powers of 1000 and KiB, MiB, and GiB are powers of 1024. A number without a
+// unit is a number of bytes.
+func ParseByteSize(value string) (uint64, error) {
+	number, multiplier := strings.TrimSpace(value), uint64(1)
+	for _, unit := range byteUnits {
+		if n, ok := strings.CutSuffix(strings.ToUpper(number), strings.ToUpper(unit.suffix)); ok {
+			number, multiplier = strings.TrimSpace(n), unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseUint(number, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * multiplier, nil
+}
+
+// memWarnFraction is the fraction of the limit at which MemoryGate warns that
+// the heap is approaching it.
+const memWarnFraction = 0.9
+
+// MemoryGate holds up new propagations while the heap is over a limit, until
+// garbage collection brings it back under a low watermark. It's meant for
+// containers with strict memory limits, where going over the limit gets the
+// service killed. A nil *MemoryGate never holds anything up.
+type MemoryGate struct {
+	limit    uint64
+	low      uint64
+	interval time.Duration
+	heap     func() uint64
+
+	mu      sync.Mutex
+	paused  bool
+	warned  bool
+	resumed chan struct{}
+}
+
+// NewMemoryGate returns a *MemoryGate that pauses once HeapInuse goes over
+// limit and resumes once it drops below low, checking every interval.
+func NewMemoryGate(limit, low uint64, interval time.Duration) *MemoryGate {
+	return &MemoryGate{
+		limit:    limit,
+		low:      low,
+		interval: interval,
+		heap:     heapInuse,
+	}
+}
+
+// heapInuse returns the number of bytes in in-use heap spans.
+func heapInuse() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
+
+// Run checks the heap every interval until the context is cancelled.
+func (g *MemoryGate) Run(ctx context.Context) {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		g.check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check reads the heap size and pauses or resumes propagation accordingly.
+func (g *MemoryGate) check() {
+	heap := g.heap()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch {
+	case !g.paused && heap > g.limit:
+		g.paused = true
+		g.resumed = make(chan struct{})
+		log.Warnf("Pausing propagation because the heap is using %d bytes, over the limit of %d", heap, g.limit)
+	case g.paused && heap < g.low:
+		g.paused = false
+		g.warned = false
+		close(g.resumed)
+		log.Infof("Resuming propagation now that the heap is using %d bytes", heap)
+	case !g.paused && !g.warned && float64(heap) > memWarnFraction*float64(g.limit):
+		g.warned = true
+		log.Warnf("The heap is using %d bytes, approaching the limit of %d", heap, g.limit)
+	case !g.paused && float64(heap) <= memWarnFraction*float64(g.limit):
+		g.warned = false
+	}
+}
+
+// Wait blocks while propagation is paused, or until the context is done, in
+// which case it returns the context's error.
+func (g *MemoryGate) Wait(ctx context.Context) error {
+	if g == nil {
+		return nil
+	}
+
+	g.mu.Lock()
+	paused, resumed := g.paused, g.resumed
+	g.mu.Unlock()
+	if !paused {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-resumed:
+		return nil
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected uint64
+		wantErr  bool
+	}{
+		{"1024", 1024, false},
+		{"10B", 10, false},
+		{"500MB", 500 * 1000 * 1000, false},
+		{"400mb", 400 * 1000 * 1000, false},
+		{"512MiB", 512 << 20, false},
+		{"2 GiB", 2 << 30, false},
+		{"1KB", 1000, false},
+		{"", 0, true},
+		{"MB", 0, true},
+		{"-5MB", 0, true},
+		{"5TB", 0, true},
+	}
+
+	for _, tt := range tests {
+		actual, err := ParseByteSize(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseByteSize(%q) returned error %v", tt.value, err)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("ParseByteSize(%q) returned %d instead of %d", tt.value, actual, tt.expected)
+		}
+	}
+}
+
+func TestMemoryGate(t *testing.T) {
+	var heap uint64
+	g := NewMemoryGate(500, 400, time.Second)
+	g.heap = func() uint64 { return heap }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	heap = 450
+	g.check()
+	if err := g.Wait(ctx); err != nil {
+		t.Fatalf("Wait() returned %v under the limit", err)
+	}
+
+	heap = 600
+	g.check()
+	if err := g.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Wait() returned %v instead of blocking over the limit", err)
+	}
+
+	// Propagation stays paused until the heap drops below the low watermark.
+	heap = 450
+	g.check()
+	if !g.paused {
+		t.Fatal("propagation resumed above the low watermark")
+	}
+
+	done := make(chan error)
+	go func() { done <- g.Wait(context.Background()) }()
+	heap = 350
+	g.check()
+	if err := <-done; err != nil {
+		t.Errorf("Wait() returned %v after resuming", err)
+	}
+}
+
+func TestNilMemoryGate(t *testing.T) {
+	var g *MemoryGate
+	if err := g.Wait(context.Background()); err != nil {
+		t.Errorf("Wait() returned %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// metadataTimeout is how long to wait for each request to the instance
+// metadata endpoint.
+const metadataTimeout = 2 * time.Second
+
+// InstanceMetadata describes the cloud instance the service is running on.
+type InstanceMetadata struct {
+	Region           string
+	AvailabilityZone string
+	InstanceID       string
+}
+
+// Fields returns the metadata values that are available as logrus fields.
+func (m *InstanceMetadata) Fields() logrus.Fields {
+	fields := logrus.Fields{}
+	if m.Region != "" {
+		fields["region"] = m.Region
+	}
+	if m.AvailabilityZone != "" {
+		fields["availability_zone"] = m.AvailabilityZone
+	}
+	if m.InstanceID != "" {
+		fields["instance_id"] = m.InstanceID
+	}
+	return fields
+}
+
+// Labels returns the metadata values that are available as Prometheus labels.
+func (m *InstanceMetadata) Labels() prometheus.Labels {
+	labels := prometheus.Labels{}
+	for name, value := range m.Fields() {
+		labels[name] = value.(string)
+	}
+	return labels
+}
+
+// fetchMetadataValue returns the value at the given path under the metadata
+// endpoint's base URL.
+func fetchMetadataValue(ctx context.Context, client *http.Client, baseURL, path string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, metadataTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(baseURL, "/")+"/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata request for %s returned %s", path, resp.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// FetchInstanceMetadata reads the instance's region, availability zone, and ID
+// from an EC2-style metadata endpoint such as
+// http://169.254.169.254/latest/meta-data/. Values that can't be retrieved are
+// logged and left empty.
+func FetchInstanceMetadata(ctx context.Context, baseURL string) *InstanceMetadata {
+	client := &http.Client{}
+	m := &InstanceMetadata{}
+
+	values := []struct {
+		path  string
+		value *string
+	}{
+		{"placement/region", &m.Region},
+		{"placement/availability-zone", &m.AvailabilityZone},
+		{"instance-id", &m.InstanceID},
+	}
+
+	for _, v := range values {
+		value, err := fetchMetadataValue(ctx, client, baseURL, v.path)
+		if err != nil {
+			log.Warnf("Unable to get %s from the instance metadata endpoint: %s", v.path, err)
+			continue
+		}
+		*v.value = value
+	}
+
+	return m
+}
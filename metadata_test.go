@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetchInstanceMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/meta-data/placement/region":
+			fmt.Fprint(w, "us-west-2")
+		case "/latest/meta-data/instance-id":
+			fmt.Fprint(w, "i-1234567890\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	m := FetchInstanceMetadata(context.Background(), server.URL+"/latest/meta-data/")
+
+	if m.Region != "us-west-2" {
+		t.Errorf("region was %s instead of us-west-2", m.Region)
+	}
+
+	if m.InstanceID != "i-1234567890" {
+		t.Errorf("instance ID was %s instead of i-1234567890", m.InstanceID)
+	}
+
+	if m.AvailabilityZone != "" {
+		t.Errorf("availability zone was %s instead of empty", m.AvailabilityZone)
+	}
+
+	fields := m.Fields()
+	if _, ok := fields["availability_zone"]; ok || len(fields) != 2 {
+		t.Errorf("unexpected fields: %v", fields)
+	}
+}
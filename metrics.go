@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// The database connection pool metrics, updated by MonitorDBPool.
+var (
+	dbOpenConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "db_open_connections",
+		Help: "The number of established connections to the database, both in use and idle.",
+	})
+
+	dbIdleConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "db_idle_connections",
+		Help: "The number of idle database connections.",
+	})
+
+	dbInUseConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "db_in_use_connections",
+		Help: "The number of database connections currently in use.",
+	})
+
+	dbWaitCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "db_wait_count",
+		Help: "The total number of times a goroutine waited for a database connection.",
+	})
+)
+
+// malformedUUIDs counts the external IDs skipped by --validate-uuid.
+var malformedUUIDs = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "malformed_uuid_total",
+	Help: "The number of jobs skipped because their external ID isn't a valid UUID.",
+})
+
+// connectionReuseRatio is the fraction of apps service connections that were
+// reused in the last propagation pass, updated by --enable-connection-reuse.
+var connectionReuseRatio = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "http_connection_reuse_ratio",
+	Help: "The fraction of connections to the apps service that were reused in the last propagation pass.",
+})
+
+// errorBudgetExhausted counts the pauses started by --error-budget.
+var errorBudgetExhausted = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "error_budget_exhausted_total",
+	Help: "The number of times propagation was paused because the error rate exceeded the error budget.",
+})
+
+// dbFailovers counts the failovers made by --db-failover-uris.
+var dbFailovers = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "db_failover_total",
+	Help: "The number of times the service failed over to another database.",
+})
+
+// unpropagatedQueryDuration measures how long the unpropagated jobs query takes
+// with and without prepared statements.
+var unpropagatedQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "unpropagated_query_duration_seconds",
+	Help: "How long the query for jobs with unpropagated status updates took.",
+}, []string{"prepared"})
+
+// currentConcurrency is the concurrency limit set by --initial-concurrency.
+var currentConcurrency = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "current_concurrency",
+	Help: "The current limit on the number of concurrent propagations.",
+})
+
+// The propagation metrics, updated by jobHandler.handle and the propagation
+// loop.
+var (
+	jobPropagations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "job_propagation_total",
+		Help: "The number of finished propagations by result, either success or failure.",
+	}, []string{"result"})
+
+	jobPropagationAttempts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "job_propagation_attempts_total",
+		Help: "The number of attempts to propagate a job's status updates, including retries.",
+	})
+
+	jobPropagationDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "job_propagation_duration_seconds",
+		Help: "How long it took to propagate a job's status updates, whether or not it succeeded.",
+	})
+
+	jobPropagationBatchSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "job_propagation_batch_size",
+		Help: "The number of jobs in the batch most recently started by the propagation loop.",
+	})
+)
+
+// metricPrefix returns the prefix that qualifies the names of the service's
+// metrics with the namespace and subsystem, the same way the Namespace and
+// Subsystem fields of the prometheus options would. The collectors are created
+// before the flags are parsed, so the prefix is applied when they're
+// registered instead.
+func metricPrefix(namespace, subsystem string) string {
+	var prefix string
+	for _, part := range []string{namespace, subsystem} {
+		if part != "" {
+			prefix += part + "_"
+		}
+	}
+	return prefix
+}
+
+// registerMetrics registers all of the service's metrics with reg.
+func registerMetrics(reg prometheus.Registerer) error {
+	collectors := []prometheus.Collector{
+		dbOpenConnections,
+		dbIdleConnections,
+		dbInUseConnections,
+		dbWaitCount,
+		malformedUUIDs,
+		connectionReuseRatio,
+		errorBudgetExhausted,
+		dbFailovers,
+		unpropagatedQueryDuration,
+		currentConcurrency,
+		jobPropagations,
+		jobPropagationAttempts,
+		jobPropagationDuration,
+		jobPropagationBatchSize,
+	}
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordDBPoolStats logs the database connection pool statistics at debug level
+// and updates the pool metrics.
+func recordDBPoolStats(d *sql.DB) {
+	stats := d.Stats()
+	dbOpenConnections.Set(float64(stats.OpenConnections))
+	dbIdleConnections.Set(float64(stats.Idle))
+	dbInUseConnections.Set(float64(stats.InUse))
+	dbWaitCount.Set(float64(stats.WaitCount))
+	log.Debugf(
+		"Database pool: %d open, %d idle, %d in use, %d waits totalling %s",
+		stats.OpenConnections, stats.Idle, stats.InUse, stats.WaitCount, stats.WaitDuration,
+	)
+}
+
+// MonitorDBPool records the database connection pool statistics every interval
+// until the context is cancelled.
+func MonitorDBPool(ctx context.Context, d *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			recordDBPoolStats(d)
+		}
+	}
+}
+
+// PushMetrics pushes all of the metrics gathered by g to the Prometheus
+// Pushgateway at url, grouped by the job and instance labels.
+func PushMetrics(url, job, instance string, g prometheus.Gatherer) error {
+	return push.New(url, job).
+		Gatherer(g).
+		Grouping("instance", instance).
+		Push()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRegisterMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	labels := prometheus.Labels{"region": "us-west-2"}
+	if err := registerMetrics(prometheus.WrapRegistererWith(labels, reg)); err != nil {
+		t.Fatalf("error calling registerMetrics(): %s", err)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("error gathering metrics: %s", err)
+	}
+
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			found := false
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "region" && label.GetValue() == "us-west-2" {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("metric %s is missing the region label", family.GetName())
+			}
+		}
+	}
+}
+
+func TestMetricPrefix(t *testing.T) {
+	tests := []struct {
+		namespace, subsystem, expected string
+	}{
+		{"cyverse", "job_status_adapter", "cyverse_job_status_adapter_"},
+		{"cyverse", "", "cyverse_"},
+		{"", "job_status_adapter", "job_status_adapter_"},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		if actual := metricPrefix(test.namespace, test.subsystem); actual != test.expected {
+			t.Errorf("metricPrefix(%q, %q) returned %q instead of %q", test.namespace, test.subsystem, actual, test.expected)
+		}
+	}
+
+	reg := prometheus.NewRegistry()
+	if err := registerMetrics(prometheus.WrapRegistererWithPrefix(metricPrefix("cyverse", "job_status_adapter"), reg)); err != nil {
+		t.Fatalf("error calling registerMetrics(): %s", err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("error gathering metrics: %s", err)
+	}
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "cyverse_job_status_adapter_") {
+			t.Errorf("metric %s isn't qualified with the namespace and subsystem", family.GetName())
+		}
+	}
+}
+
+func TestRecordDBPoolStats(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	if err = db.Ping(); err != nil {
+		t.Fatalf("error pinging the mock db: %s", err)
+	}
+
+	recordDBPoolStats(db)
+
+	if open := testutil.ToFloat64(dbOpenConnections); open != 1 {
+		t.Errorf("db_open_connections was %f instead of 1", open)
+	}
+
+	if idle := testutil.ToFloat64(dbIdleConnections); idle != 1 {
+		t.Errorf("db_idle_connections was %f instead of 1", idle)
+	}
+}
+
+func TestPushMetrics(t *testing.T) {
+	var method, path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	reg := prometheus.NewRegistry()
+	if err := registerMetrics(reg); err != nil {
+		t.Fatalf("error calling registerMetrics(): %s", err)
+	}
+
+	if err := PushMetrics(server.URL, "job-status-to-apps-adapter", "host-1", reg); err != nil {
+		t.Fatalf("error calling PushMetrics(): %s", err)
+	}
+
+	if method != http.MethodPut {
+		t.Errorf("method was %s instead of PUT", method)
+	}
+	if expected := "/metrics/job/job-status-to-apps-adapter/instance/host-1"; path != expected {
+		t.Errorf("path was %s instead of %s", path, expected)
+	}
+}
+
+func TestHandleRecordsPropagationMetrics(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock database: %s", err)
+	}
+	defer db.Close()
+
+	successes := testutil.ToFloat64(jobPropagations.WithLabelValues("success"))
+	failures := testutil.ToFloat64(jobPropagations.WithLabelValues("failure"))
+	attempts := testutil.ToFloat64(jobPropagationAttempts)
+
+	stub := &stubPropagator{}
+	h := &jobHandler{db: db, maxRetries: 3, propagator: stub, stats: &PropagationStats{}}
+	h.handle(context.Background(), "job-1", 0, NewRetryBudget(0))
+
+	stub.err = errors.New("the apps service is down")
+	mock.ExpectExec("set propagation_attempts = propagation_attempts \\+ 1").
+		WithArgs("job-2", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	h.handle(context.Background(), "job-2", 0, NewRetryBudget(0))
+
+	if actual := testutil.ToFloat64(jobPropagations.WithLabelValues("success")) - successes; actual != 1 {
+		t.Errorf("recorded %f successes instead of 1", actual)
+	}
+	if actual := testutil.ToFloat64(jobPropagations.WithLabelValues("failure")) - failures; actual != 1 {
+		t.Errorf("recorded %f failures instead of 1", actual)
+	}
+	if actual := testutil.ToFloat64(jobPropagationAttempts) - attempts; actual != 2 {
+		t.Errorf("recorded %f attempts instead of 2", actual)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
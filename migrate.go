@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+// migrations contains the schema changes for the tables owned by this service.
+// Each statement must be safe to run more than once.
+var migrations = []string{
+	`create table if not exists job_propagation_dead_letters (
+		external_id text not null,
+		failed_at timestamp with time zone not null default now(),
+		error_message text not null,
+		original_attempts bigint not null default 0
+	)`,
+	`create index if not exists job_propagation_dead_letters_failed_at_index
+		on job_propagation_dead_letters (failed_at)`,
+	`create table if not exists jobs_to_propagate (
+		external_id text primary key,
+		claimed_by text not null,
+		claimed_at timestamp with time zone not null default now()
+	)`,
+	`create sequence if not exists job_propagation_events_event_id_seq`,
+	`create table if not exists job_propagation_events (
+		event_id bigint primary key default nextval('job_propagation_events_event_id_seq'),
+		external_id text not null,
+		event_type text not null,
+		payload jsonb not null,
+		occurred_at timestamp with time zone not null default now()
+	)`,
+	`create index if not exists job_propagation_events_external_id_index
+		on job_propagation_events (external_id)`,
+	`alter table job_status_updates add column if not exists last_propagation_attempt bigint`,
+}
+
+// Migrate applies the service's schema changes while holding a Postgres advisory
+// lock, so that only one replica migrates at a time. Replicas that start while
+// another one is migrating wait for it to finish.
+func Migrate(ctx context.Context, d *sql.DB) (err error) {
+	conn, err := d.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, "select pg_advisory_lock(hashtext($1))", serviceName); err != nil {
+		return err
+	}
+	defer func() {
+		// Use a fresh context so that the lock is released even if ctx is done.
+		_, unlockErr := conn.ExecContext(context.Background(), "select pg_advisory_unlock(hashtext($1))", serviceName)
+		if err == nil {
+			err = unlockErr
+		}
+	}()
+
+	for _, stmt := range migrations {
+		if _, err = conn.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestMigrate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock database: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("select pg_advisory_lock").WithArgs(serviceName).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("create table if not exists job_propagation_dead_letters").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("create index if not exists").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("create table if not exists jobs_to_propagate").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("create sequence if not exists job_propagation_events_event_id_seq").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("create table if not exists job_propagation_events").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("create index if not exists job_propagation_events_external_id_index").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("alter table job_status_updates add column if not exists last_propagation_attempt").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("select pg_advisory_unlock").WithArgs(serviceName).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err = Migrate(context.Background(), db); err != nil {
+		t.Errorf("error calling Migrate(): %s", err)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrateUnlocksOnError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock database: %s", err)
+	}
+	defer db.Close()
+
+	migrationErr := errors.New("permission denied")
+	mock.ExpectExec("select pg_advisory_lock").WithArgs(serviceName).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("create table if not exists job_propagation_dead_letters").WillReturnError(migrationErr)
+	mock.ExpectExec("select pg_advisory_unlock").WithArgs(serviceName).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err = Migrate(context.Background(), db); !errors.Is(err, migrationErr) {
+		t.Errorf("Migrate() returned %v instead of %v", err, migrationErr)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
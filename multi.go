@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// JobPropagator is implemented by types that can push a job status update to
+// the apps service.
+type JobPropagator interface {
+	Propagate(ctx context.Context, uuid string) error
+}
+
+// MultiDBPropagator fans job status updates out to several apps service
+// instances, e.g. a primary and a shadow used for blue-green testing.
+//
+// Whether an update was propagated is only recorded once for all of the
+// instances, so delivery to each instance is at least once: if an update is
+// retried because an instance failed, it's sent again to the instances that
+// already received it. Without RequireAll, an instance that failed doesn't get
+// the update at all once another instance received it.
+type MultiDBPropagator struct {
+	// Parallel sends each update to all of the instances at once instead of
+	// one after the other.
+	Parallel bool
+
+	// RequireAll makes a propagation fail if any instance fails. Otherwise, it
+	// only fails if every instance fails. It's true by default.
+	RequireAll bool
+
+	db          *sql.DB
+	propagators []*Propagator
+}
+
+// NewMultiDBPropagator returns a *MultiDBPropagator with a *Propagator for each
+// of the apps URIs, all of which share the same options.
+func NewMultiDBPropagator(d *sql.DB, appsURIs []string, opts *PropagatorOptions) (*MultiDBPropagator, error) {
+	if len(appsURIs) == 0 {
+		return nil, errors.New("at least one apps URI is required")
+	}
+	var propagators []*Propagator
+	for _, appsURI := range appsURIs {
+		p, err := NewPropagator(d, appsURI, opts)
+		if err != nil {
+			return nil, err
+		}
+		propagators = append(propagators, p)
+	}
+	return &MultiDBPropagator{RequireAll: true, db: d, propagators: propagators}, nil
+}
+
+// Propagate pushes the job's status updates to each of the apps service
+// instances in the order they were sent. Every instance is attempted even if an
+// earlier one fails; the returned error joins all of the failures together. An
+// update is only marked as propagated once enough instances received it to
+// satisfy RequireAll.
+func (m *MultiDBPropagator) Propagate(ctx context.Context, uuid string) error {
+	return m.propagators[0].wrapError(uuid, propagateInOrder(ctx, m.db, uuid, m.sendAll))
+}
+
+// sendAll pushes the update to each of the apps service instances.
+func (m *MultiDBPropagator) sendAll(ctx context.Context, jsu JobStatusUpdate) error {
+	errs := make([]error, len(m.propagators))
+	if m.Parallel {
+		var wg sync.WaitGroup
+		for i, p := range m.propagators {
+			wg.Add(1)
+			go func(i int, p *Propagator) {
+				defer wg.Done()
+				errs[i] = p.sendUpdate(ctx, jsu)
+			}(i, p)
+		}
+		wg.Wait()
+	} else {
+		for i, p := range m.propagators {
+			errs[i] = p.sendUpdate(ctx, jsu)
+		}
+	}
+
+	var failed int
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	err := errors.Join(errs...)
+	if failed > 0 && failed < len(errs) && !m.RequireAll {
+		log.Warnf("Job status update %s for job %s reached %d of %d apps URIs: %s", jsu.ID, jsu.UUID, len(errs)-failed, len(errs), err)
+		return nil
+	}
+	return err
+}
+
+// URIGroupStrategy determines when the URIs in a URIGroup are used.
+type URIGroupStrategy string
+
+const (
+	// StrategyPrimary groups are tried first.
+	StrategyPrimary URIGroupStrategy = "primary"
+
+	// StrategyBackup groups are only tried if every primary URI failed.
+	StrategyBackup URIGroupStrategy = "backup"
+)
+
+// URIGroup is a named set of apps callback URIs that share a strategy.
+type URIGroup struct {
+	Name     string
+	URIs     []string
+	Strategy URIGroupStrategy
+}
+
+// ParseURIGroups parses a comma-separated list of group:uri pairs, e.g.
+// primary:http://apps1/callbacks,backup:http://apps2/callbacks. The group name
+// is also its strategy, so it must be either primary or backup. URIs without a
+// group are primary. The primary group, if any, comes first in the result.
+func ParseURIGroups(value string) ([]URIGroup, error) {
+	groups := map[URIGroupStrategy]*URIGroup{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, uri, found := strings.Cut(entry, ":")
+		if !found || strings.HasPrefix(uri, "//") {
+			// There's no group, just the URI's scheme.
+			name, uri = string(StrategyPrimary), entry
+		}
+
+		strategy := URIGroupStrategy(name)
+		if strategy != StrategyPrimary && strategy != StrategyBackup {
+			return nil, fmt.Errorf("unknown apps URI group %q in %q; it must be primary or backup", name, entry)
+		}
+		if uri == "" {
+			return nil, fmt.Errorf("missing URI in %q", entry)
+		}
+
+		if groups[strategy] == nil {
+			groups[strategy] = &URIGroup{Name: name, Strategy: strategy}
+		}
+		groups[strategy].URIs = append(groups[strategy].URIs, uri)
+	}
+
+	var retval []URIGroup
+	for _, strategy := range []URIGroupStrategy{StrategyPrimary, StrategyBackup} {
+		if g := groups[strategy]; g != nil {
+			retval = append(retval, *g)
+		}
+	}
+	if len(retval) == 0 {
+		return nil, errors.New("at least one apps URI is required")
+	}
+	return retval, nil
+}
+
+// MultiAppsURIPropagator pushes job status updates to the first apps service
+// instance that accepts them. The primary URIs are tried in order, followed by
+// the backup URIs.
+type MultiAppsURIPropagator struct {
+	db          *sql.DB
+	groups      []URIGroup
+	propagators [][]*Propagator
+}
+
+// NewMultiAppsURIPropagator returns a *MultiAppsURIPropagator with a
+// *Propagator for each URI in the groups, all of which share the same options.
+func NewMultiAppsURIPropagator(d *sql.DB, groups []URIGroup, opts *PropagatorOptions) (*MultiAppsURIPropagator, error) {
+	if len(groups) == 0 {
+		return nil, errors.New("at least one apps URI group is required")
+	}
+	m := &MultiAppsURIPropagator{db: d, groups: groups}
+	for _, g := range groups {
+		if len(g.URIs) == 0 {
+			return nil, fmt.Errorf("the apps URI group %s has no URIs", g.Name)
+		}
+		var propagators []*Propagator
+		for _, appsURI := range g.URIs {
+			p, err := NewPropagator(d, appsURI, opts)
+			if err != nil {
+				return nil, err
+			}
+			propagators = append(propagators, p)
+		}
+		m.propagators = append(m.propagators, propagators)
+	}
+	return m, nil
+}
+
+// Propagate pushes the job's status updates to the apps service in the order
+// they were sent, marking each one as propagated once an instance accepts it.
+func (m *MultiAppsURIPropagator) Propagate(ctx context.Context, uuid string) error {
+	return m.propagators[0][0].wrapError(uuid, propagateInOrder(ctx, m.db, uuid, m.sendFirst))
+}
+
+// sendFirst pushes the update to each apps service instance in turn until one
+// of them accepts it. The returned error joins all of the failures together if
+// none of them did.
+func (m *MultiAppsURIPropagator) sendFirst(ctx context.Context, jsu JobStatusUpdate) error {
+	log := loggerFromContext(ctx)
+
+	var errs []error
+	for i, g := range m.groups {
+		for _, p := range m.propagators[i] {
+			err := p.sendUpdate(ctx, jsu)
+			if err == nil {
+				if g.Strategy == StrategyBackup {
+					log.Warnf("Propagated job %s to the %s group at %s after the primary URIs failed", jsu.UUID, g.Name, p.logURI)
+				}
+				return nil
+			}
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				return errors.Join(errs...)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ReadAppsURIs reads a list of apps callback URIs from a file containing one
+// URI per line. Blank lines and lines starting with # are ignored.
+func ReadAppsURIs(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var retval []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		retval = append(retval, line)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return retval, nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestMultiDBPropagator(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	var calls int
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		fmt.Fprintln(w, "Hello")
+	}))
+	defer good.Close()
+
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+
+	expectUpdates(mock, "external-id", "update-1")
+	expectMarked(mock, "update-1")
+
+	m, err := NewMultiDBPropagator(db, []string{good.URL, good.URL}, nil)
+	if err != nil {
+		t.Fatalf("error calling NewMultiDBPropagator(): %s", err)
+	}
+
+	if err = m.Propagate(context.Background(), "external-id"); err != nil {
+		t.Errorf("error from Propagate(): %s", err)
+	}
+
+	if calls != 2 {
+		t.Errorf("apps service was called %d times instead of 2", calls)
+	}
+
+	expectUpdates(mock, "external-id", "update-1")
+
+	m, err = NewMultiDBPropagator(db, []string{bad.URL, good.URL}, nil)
+	if err != nil {
+		t.Fatalf("error calling NewMultiDBPropagator(): %s", err)
+	}
+
+	if err = m.Propagate(context.Background(), "external-id"); err == nil {
+		t.Error("expected an error from Propagate() when one instance fails")
+	}
+
+	if calls != 3 {
+		t.Errorf("apps service was called %d times instead of 3", calls)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("the job wasn't marked as propagated: %s", err)
+	}
+}
+
+func TestMultiDBPropagatorPartialFailure(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	var calls atomic.Int64
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		fmt.Fprintln(w, "Hello")
+	}))
+	defer good.Close()
+
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+
+	m, err := NewMultiDBPropagator(db, []string{bad.URL, good.URL}, nil)
+	if err != nil {
+		t.Fatalf("error calling NewMultiDBPropagator(): %s", err)
+	}
+	m.Parallel = true
+	m.RequireAll = false
+
+	expectUpdates(mock, "external-id", "update-1")
+	expectMarked(mock, "update-1")
+
+	if err = m.Propagate(context.Background(), "external-id"); err != nil {
+		t.Errorf("error from Propagate() when one instance succeeds: %s", err)
+	}
+	if actual := calls.Load(); actual != 2 {
+		t.Errorf("apps service was called %d times instead of 2", actual)
+	}
+
+	m, err = NewMultiDBPropagator(db, []string{bad.URL, bad.URL}, nil)
+	if err != nil {
+		t.Fatalf("error calling NewMultiDBPropagator(): %s", err)
+	}
+	m.RequireAll = false
+
+	expectUpdates(mock, "external-id", "update-1")
+
+	if err = m.Propagate(context.Background(), "external-id"); err == nil {
+		t.Error("expected an error from Propagate() when every instance fails")
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet database expectations: %s", err)
+	}
+}
+
+func TestReadAppsURIs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uris")
+	contents := "# primary\nhttp://apps1/callbacks\n\n  http://apps2/callbacks  \n"
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("error writing URIs file: %s", err)
+	}
+
+	uris, err := ReadAppsURIs(path)
+	if err != nil {
+		t.Fatalf("error calling ReadAppsURIs(): %s", err)
+	}
+
+	if len(uris) != 2 || uris[0] != "http://apps1/callbacks" || uris[1] != "http://apps2/callbacks" {
+		t.Errorf("unexpected URIs: %v", uris)
+	}
+}
+
+func TestParseURIGroups(t *testing.T) {
+	groups, err := ParseURIGroups("backup:http://apps3/callbacks, primary:http://apps1/callbacks,http://apps2/callbacks")
+	if err != nil {
+		t.Fatalf("error calling ParseURIGroups(): %s", err)
+	}
+
+	expected := []URIGroup{
+		{Name: "primary", URIs: []string{"http://apps1/callbacks", "http://apps2/callbacks"}, Strategy: StrategyPrimary},
+		{Name: "backup", URIs: []string{"http://apps3/callbacks"}, Strategy: StrategyBackup},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("ParseURIGroups() returned %#v instead of %#v", groups, expected)
+	}
+
+	for _, value := range []string{"", "standby:http://apps1/callbacks", "primary:"} {
+		if _, err = ParseURIGroups(value); err == nil {
+			t.Errorf("ParseURIGroups(%q) didn't return an error", value)
+		}
+	}
+}
+
+func TestMultiAppsURIPropagator(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	var goodCalls, badCalls int
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		goodCalls++
+		fmt.Fprintln(w, "Hello")
+	}))
+	defer good.Close()
+
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badCalls++
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+
+	tests := []struct {
+		name      string
+		groups    []URIGroup
+		succeeds  bool
+		goodCalls int
+		badCalls  int
+	}{
+		{
+			name: "primary succeeds",
+			groups: []URIGroup{
+				{Name: "primary", URIs: []string{good.URL}, Strategy: StrategyPrimary},
+				{Name: "backup", URIs: []string{bad.URL}, Strategy: StrategyBackup},
+			},
+			succeeds:  true,
+			goodCalls: 1,
+		},
+		{
+			name: "fails over to backup",
+			groups: []URIGroup{
+				{Name: "primary", URIs: []string{bad.URL, bad.URL}, Strategy: StrategyPrimary},
+				{Name: "backup", URIs: []string{good.URL}, Strategy: StrategyBackup},
+			},
+			succeeds:  true,
+			goodCalls: 1,
+			badCalls:  2,
+		},
+		{
+			name: "everything fails",
+			groups: []URIGroup{
+				{Name: "primary", URIs: []string{bad.URL}, Strategy: StrategyPrimary},
+				{Name: "backup", URIs: []string{bad.URL}, Strategy: StrategyBackup},
+			},
+			badCalls: 2,
+		},
+	}
+
+	for _, test := range tests {
+		goodCalls, badCalls = 0, 0
+		expectUpdates(mock, "external-id", "update-1")
+		if test.succeeds {
+			expectMarked(mock, "update-1")
+		}
+
+		m, err := NewMultiAppsURIPropagator(db, test.groups, nil)
+		if err != nil {
+			t.Fatalf("%s: error calling NewMultiAppsURIPropagator(): %s", test.name, err)
+		}
+
+		err = m.Propagate(context.Background(), "external-id")
+		if test.succeeds && err != nil {
+			t.Errorf("%s: error from Propagate(): %s", test.name, err)
+		}
+		if !test.succeeds && err == nil {
+			t.Errorf("%s: expected an error from Propagate()", test.name)
+		}
+		if goodCalls != test.goodCalls || badCalls != test.badCalls {
+			t.Errorf("%s: made %d good and %d bad calls instead of %d and %d", test.name, goodCalls, badCalls, test.goodCalls, test.badCalls)
+		}
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("the job wasn't marked as propagated: %s", err)
+	}
+}
+
+func TestMultiDBPropagatorRedelivers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	var goodCalls, flakyCalls atomic.Int64
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		goodCalls.Add(1)
+		fmt.Fprintln(w, "Hello")
+	}))
+	defer good.Close()
+
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if flakyCalls.Add(1) == 1 {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "Hello")
+	}))
+	defer flaky.Close()
+
+	m, err := NewMultiDBPropagator(db, []string{good.URL, flaky.URL}, nil)
+	if err != nil {
+		t.Fatalf("error calling NewMultiDBPropagator(): %s", err)
+	}
+
+	// The update isn't marked until both instances accept it, so the retry
+	// sends it to the instance that already has it.
+	expectUpdates(mock, "external-id", "update-1")
+	if err = m.Propagate(context.Background(), "external-id"); err == nil {
+		t.Error("expected an error from Propagate() when one instance fails")
+	}
+
+	expectUpdates(mock, "external-id", "update-1")
+	expectMarked(mock, "update-1")
+	if err = m.Propagate(context.Background(), "external-id"); err != nil {
+		t.Errorf("error from Propagate() on the retry: %s", err)
+	}
+
+	if actual := goodCalls.Load(); actual != 2 {
+		t.Errorf("the instance that accepted the update was called %d times instead of 2", actual)
+	}
+	if actual := flakyCalls.Load(); actual != 2 {
+		t.Errorf("the instance that failed was called %d times instead of 2", actual)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet database expectations: %s", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// maxPendingPageSize is the largest page_size accepted by PendingJobsHandler.
+const maxPendingPageSize = 1000
+
+// pendingJobsPage is the response body of PendingJobsHandler.
+type pendingJobsPage struct {
+	Jobs     []string `json:"jobs"`
+	Total    int      `json:"total"`
+	Page     int      `json:"page"`
+	PageSize int      `json:"page_size"`
+}
+
+// queryInt returns the positive integer query parameter with the given name, or
+// def if it isn't set.
+func queryInt(r *http.Request, name string, def int) (int, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, false
+	}
+	return n, true
+}
+
+// PendingJobsHandler lists the jobs that Unpropagated returns for q as JSON, one
+// page at a time. Pages are numbered from 1 and selected with the page and
+// page_size query parameters, which default to 1 and 100. Only the requested
+// page is read from the database.
+func PendingJobsHandler(d *sql.DB, q *JobQuery) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, ok := queryInt(r, "page", 1)
+		if !ok {
+			http.Error(w, "page must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		pageSize, ok := queryInt(r, "page_size", 100)
+		if !ok || pageSize > maxPendingPageSize {
+			http.Error(w, "page_size must be an integer between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+
+		total, err := CountUnpropagated(r.Context(), d, q)
+		if err != nil {
+			log.Errorf("Error counting the pending jobs: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		pageQuery := *q
+		pageQuery.Limit, pageQuery.Offset = pageSize, (page-1)*pageSize
+		jobs, err := Unpropagated(r.Context(), d, &pageQuery)
+		if err != nil {
+			log.Errorf("Error listing the pending jobs: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		body := pendingJobsPage{
+			Jobs:     append([]string{}, jobs...),
+			Total:    total,
+			Page:     page,
+			PageSize: pageSize,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(body); err != nil {
+			log.Errorf("Error writing the pending jobs response: %s", err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPendingJobsHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock database: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("select count\\(\\*\\) from").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(5))
+	mock.ExpectQuery("select u.external_id.*limit \\$3 offset \\$4").
+		WithArgs(int64(3), 5, 2, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"external_id"}).AddRow("job-3").AddRow("job-4"))
+
+	w := httptest.NewRecorder()
+	handler := PendingJobsHandler(db, &JobQuery{MaxRetries: 3, DefaultPriority: 5})
+	handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/pending?page=2&page_size=2", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status code was %d instead of %d", w.Code, http.StatusOK)
+	}
+
+	var page pendingJobsPage
+	if err = json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("error parsing the response body: %s", err)
+	}
+	if len(page.Jobs) != 2 || page.Jobs[0] != "job-3" || page.Jobs[1] != "job-4" {
+		t.Errorf("unexpected jobs on page 2: %v", page.Jobs)
+	}
+	if page.Total != 5 || page.Page != 2 || page.PageSize != 2 {
+		t.Errorf("unexpected page: %+v", page)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	for _, query := range []string{"page=0", "page_size=abc", "page_size=1001"} {
+		w = httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/pending?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("status code for %s was %d instead of %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+)
+
+// QueryLogConnector is a driver.Connector whose connections log each SQL
+// statement they run at the debug level.
+type QueryLogConnector struct {
+	driver.Connector
+}
+
+// NewQueryLogConnector returns a *QueryLogConnector that wraps the connections
+// made by next.
+func NewQueryLogConnector(next driver.Connector) *QueryLogConnector {
+	return &QueryLogConnector{Connector: next}
+}
+
+// Connect returns a new connection from the wrapped connector. Connections that
+// don't support the interfaces that lib/pq connections do are returned as they
+// are.
+func (c *QueryLogConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if pc, ok := conn.(pqConn); ok {
+		return &queryLogConn{pqConn: pc}, nil
+	}
+	return conn, nil
+}
+
+// queryLogConn logs the statements run on a connection.
+type queryLogConn struct {
+	pqConn
+}
+
+// logQuery logs the query, with its whitespace collapsed, and its arguments.
+func logQuery(ctx context.Context, query string, args []driver.NamedValue) {
+	values := make([]any, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	loggerFromContext(ctx).WithField("args", values).Debugf("SQL: %s", strings.Join(strings.Fields(query), " "))
+}
+
+func (c *queryLogConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	logQuery(ctx, query, args)
+	return c.pqConn.ExecContext(ctx, query, args)
+}
+
+func (c *queryLogConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	logQuery(ctx, query, args)
+	return c.pqConn.QueryContext(ctx, query, args)
+}
+
+func (c *queryLogConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	logQuery(ctx, query, nil)
+	return c.pqConn.PrepareContext(ctx, query)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// recordingConn is a pqConn that records the statements it runs.
+type recordingConn struct {
+	pqConn
+	execs []string
+}
+
+func (c *recordingConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	c.execs = append(c.execs, query)
+	return driver.RowsAffected(1), nil
+}
+
+type recordingConnector struct {
+	conn *recordingConn
+}
+
+func (r *recordingConnector) Connect(context.Context) (driver.Conn, error) {
+	return r.conn, nil
+}
+
+func (r *recordingConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+func TestQueryLogConnector(t *testing.T) {
+	hook := logtest.NewLocal(log.Logger)
+	defer log.Logger.ReplaceHooks(make(logrus.LevelHooks))
+	level := log.Logger.GetLevel()
+	log.Logger.SetLevel(logrus.DebugLevel)
+	defer log.Logger.SetLevel(level)
+
+	inner := &recordingConn{}
+	conn, err := NewQueryLogConnector(&recordingConnector{conn: inner}).Connect(context.Background())
+	if err != nil {
+		t.Fatalf("Connect returned an error: %s", err)
+	}
+
+	query := `
+	update job_status_updates
+	   set propagated = 'true'
+	 where id = $1`
+	_, err = conn.(driver.ExecerContext).ExecContext(context.Background(), query, []driver.NamedValue{{Ordinal: 1, Value: "update-1"}})
+	if err != nil {
+		t.Fatalf("ExecContext returned an error: %s", err)
+	}
+
+	if len(inner.execs) != 1 {
+		t.Fatalf("the statement was run %d times instead of once", len(inner.execs))
+	}
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatal("the statement wasn't logged")
+	}
+	expected := "SQL: update job_status_updates set propagated = 'true' where id = $1"
+	if entry.Message != expected {
+		t.Errorf("the log message was %q instead of %q", entry.Message, expected)
+	}
+	if args, ok := entry.Data["args"].([]any); !ok || len(args) != 1 || args[0] != "update-1" {
+		t.Errorf("unexpected args field: %v", entry.Data["args"])
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// SignatureHeader is the request header that carries the HMAC-SHA256 signature
+// of the request body.
+const SignatureHeader = "X-Signature"
+
+// SignBody returns the value of the X-Signature header for the body: the
+// hex-encoded HMAC-SHA256 of the body computed with the key, prefixed with
+// "sha256=".
+func SignBody(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+// verifySignature checks the X-Signature header the way the apps service would.
+func verifySignature(key []byte, r *http.Request) (bool, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return false, err
+	}
+	signature, ok := strings.CutPrefix(r.Header.Get("X-Signature"), "sha256=")
+	if !ok {
+		return false, nil
+	}
+	actual, err := hex.DecodeString(signature)
+	if err != nil {
+		return false, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hmac.Equal(actual, mac.Sum(nil)), nil
+}
+
+func TestPropagateSignsRequests(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	key, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	var verified bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		if verified, err = verifySignature(key, r); err != nil {
+			t.Errorf("error verifying the signature: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	expectUpdates(mock, "external-id", "update-1")
+	expectMarked(mock, "update-1")
+
+	p, err := NewPropagator(db, server.URL, &PropagatorOptions{SigningKey: key})
+	if err != nil {
+		t.Fatalf("error creating the propagator: %s", err)
+	}
+	if err = p.Propagate(context.Background(), "external-id"); err != nil {
+		t.Fatalf("error from Propagate(): %s", err)
+	}
+
+	if !verified {
+		t.Error("the request signature didn't match the body")
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSignBody(t *testing.T) {
+	// Computed with: printf 'hello' | openssl dgst -sha256 -hmac key
+	expected := "sha256=9307b3b915efb5171ff14d8cb55fbcc798c6c0ef1456d66ded1a6aa723a58b7b"
+	if actual := SignBody([]byte("key"), []byte("hello")); actual != expected {
+		t.Errorf("SignBody returned %s instead of %s", actual, expected)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ClaimJobs copies the unpropagated jobs into the jobs_to_propagate staging
+// table in a single transaction and returns the ones that were claimed, in the
+// order Unpropagated returned them. Jobs that another replica has already
+// claimed are skipped. Claims made before staleBefore are released first, so
+// that jobs claimed by a replica that died mid-pass are picked up again.
+func ClaimJobs(ctx context.Context, d TxBeginner, timeouts Timeouts, q *JobQuery, owner string, staleBefore time.Time) ([]string, error) {
+	var claimed []string
+	err := InTx(ctx, d, timeouts, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, "delete from jobs_to_propagate where claimed_at < $1", staleBefore)
+		if err != nil {
+			return err
+		}
+		if released, err := res.RowsAffected(); err == nil && released > 0 {
+			log.Warnf("Released %d stale claims from the jobs_to_propagate table", released)
+		}
+
+		pending, err := Unpropagated(ctx, tx, q)
+		if err != nil || len(pending) == 0 {
+			return err
+		}
+
+		rows, err := tx.QueryContext(ctx, `
+			insert into jobs_to_propagate (external_id, claimed_by)
+			select unnest($1::text[]), $2
+			    on conflict (external_id) do nothing
+			returning external_id`, pq.Array(pending), owner)
+		if err != nil {
+			return err
+		}
+		ids, err := scanExternalIDs(rows)
+		if err != nil {
+			return err
+		}
+
+		isClaimed := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			isClaimed[id] = true
+		}
+		for _, id := range pending {
+			if isClaimed[id] {
+				claimed = append(claimed, id)
+			}
+		}
+		return nil
+	})
+	return claimed, err
+}
+
+// ReleaseClaim removes the job from the jobs_to_propagate staging table.
+func ReleaseClaim(ctx context.Context, d *sql.DB, externalID string) error {
+	_, err := d.ExecContext(ctx, "delete from jobs_to_propagate where external_id = $1", externalID)
+	return err
+}
+
+// ReleaseClaims removes all of the owner's claims from the jobs_to_propagate
+// staging table, so that the jobs it claimed but didn't propagate, e.g. because
+// they were filtered out or deferred, can be picked up by any replica on the
+// next pass instead of waiting for the claims to go stale. It returns the
+// number of claims that were released.
+func ReleaseClaims(ctx context.Context, d DBTX, owner string) (int64, error) {
+	res, err := d.ExecContext(ctx, "delete from jobs_to_propagate where claimed_by = $1", owner)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// StagingTablePropagator propagates jobs claimed by ClaimJobs and removes
+// their claims from the jobs_to_propagate staging table afterwards. Failed
+// jobs are released as well, so that any replica can retry them on a later
+// pass.
+type StagingTablePropagator struct {
+	db         *sql.DB
+	propagator JobPropagator
+}
+
+// NewStagingTablePropagator returns a *StagingTablePropagator that uses p to
+// propagate the claimed jobs.
+func NewStagingTablePropagator(d *sql.DB, p JobPropagator) *StagingTablePropagator {
+	return &StagingTablePropagator{db: d, propagator: p}
+}
+
+// Propagate pushes the update to the apps service and then releases the job's
+// claim. Errors releasing the claim are only logged, since the claim expires
+// on its own and the outcome of the propagation is what matters to the caller.
+func (s *StagingTablePropagator) Propagate(ctx context.Context, uuid string) error {
+	err := s.propagator.Propagate(ctx, uuid)
+
+	// Use a fresh context so that the claim is released even if the pass timed
+	// out.
+	if releaseErr := ReleaseClaim(context.Background(), s.db, uuid); releaseErr != nil {
+		loggerFromContext(ctx).Errorf("Error releasing the claim on job %s: %s", uuid, releaseErr)
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestClaimJobs(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	staleBefore := time.Now().Add(-time.Minute)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("delete from jobs_to_propagate where claimed_at < \\$1").
+		WithArgs(staleBefore).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("select u.external_id").
+		WithArgs(3, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"external_id"}).AddRow("job-1").AddRow("job-2").AddRow("job-3"))
+	mock.ExpectQuery("insert into jobs_to_propagate").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id"}).AddRow("job-3").AddRow("job-1"))
+	mock.ExpectCommit()
+
+	claimed, err := ClaimJobs(context.Background(), db, Timeouts{}, &JobQuery{MaxRetries: 3}, "replica-1", staleBefore)
+	if err != nil {
+		t.Fatalf("error from ClaimJobs(): %s", err)
+	}
+
+	// The claimed jobs keep the order in which they were returned by the
+	// unpropagated jobs query.
+	expected := []string{"job-1", "job-3"}
+	if !reflect.DeepEqual(claimed, expected) {
+		t.Errorf("claimed %v instead of %v", claimed, expected)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+// stubPropagator returns err from every call to Propagate.
+type stubPropagator struct {
+	err error
+}
+
+func (s *stubPropagator) Propagate(ctx context.Context, uuid string) error {
+	return s.err
+}
+
+func TestStagingTablePropagator(t *testing.T) {
+	propagateErr := errors.New("the apps service is down")
+
+	for _, expected := range []error{nil, propagateErr} {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error occurred creating the mock db: %s", err)
+		}
+
+		mock.ExpectExec("delete from jobs_to_propagate where external_id = \\$1").
+			WithArgs("job-1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		p := NewStagingTablePropagator(db, &stubPropagator{err: expected})
+		if err = p.Propagate(context.Background(), "job-1"); err != expected {
+			t.Errorf("Propagate() returned %v instead of %v", err, expected)
+		}
+
+		if err = mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("the claim wasn't released after Propagate() returned %v: %s", expected, err)
+		}
+		db.Close()
+	}
+}
+
+func TestReleaseClaims(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error occurred creating the mock db: %s", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("delete from jobs_to_propagate where claimed_by = \\$1").
+		WithArgs("replica-1").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	released, err := ReleaseClaims(context.Background(), db, "replica-1")
+	if err != nil {
+		t.Fatalf("error from ReleaseClaims(): %s", err)
+	}
+	if released != 3 {
+		t.Errorf("ReleaseClaims() released %d claims instead of 3", released)
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
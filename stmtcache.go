@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// StmtCache keeps up to size prepared statements, keyed by their query text,
+// so that repeated queries don't have to be parsed and planned every time. The
+// oldest statement is closed when a new one would exceed the size. A nil
+// *StmtCache runs queries without preparing them.
+type StmtCache struct {
+	db   *sql.DB
+	size int
+
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+	order []string
+}
+
+// NewStmtCache returns a StmtCache that prepares statements on d.
+func NewStmtCache(d *sql.DB, size int) *StmtCache {
+	return &StmtCache{
+		db:    d,
+		size:  size,
+		stmts: make(map[string]*sql.Stmt),
+	}
+}
+
+// Prepare returns the prepared statement for the query, preparing it if it isn't
+// in the cache yet.
+func (c *StmtCache) Prepare(ctx context.Context, query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if stmt, ok := c.stmts[query]; ok {
+		return stmt, nil
+	}
+
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.order) >= c.size {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		c.stmts[oldest].Close()
+		delete(c.stmts, oldest)
+	}
+	c.stmts[query] = stmt
+	c.order = append(c.order, query)
+
+	return stmt, nil
+}
+
+// QueryContext runs the query on d using a prepared statement, which is bound to
+// the transaction if d is a *sql.Tx.
+func (c *StmtCache) QueryContext(ctx context.Context, d DBTX, query string, args ...any) (*sql.Rows, error) {
+	if c == nil {
+		return d.QueryContext(ctx, query, args...)
+	}
+
+	stmt, err := c.Prepare(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if tx, ok := d.(*sql.Tx); ok {
+		stmt = tx.StmtContext(ctx, stmt)
+	}
+	return stmt.QueryContext(ctx, args...)
+}
+
+// Close closes all of the prepared statements in the cache.
+func (c *StmtCache) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, stmt := range c.stmts {
+		stmt.Close()
+	}
+	c.stmts = make(map[string]*sql.Stmt)
+	c.order = nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestStmtCache(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error creating the mock database: %s", err)
+	}
+	defer db.Close()
+
+	first := mock.ExpectPrepare("select 1")
+	first.ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+	first.ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+	mock.ExpectPrepare("select 2").ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(2))
+
+	c := NewStmtCache(db, 1)
+	ctx := context.Background()
+
+	// The second query reuses the first statement, and the third one evicts it.
+	for _, query := range []string{"select 1", "select 1", "select 2"} {
+		rows, err := c.QueryContext(ctx, db, query)
+		if err != nil {
+			t.Fatalf("error running %q: %s", query, err)
+		}
+		rows.Close()
+	}
+
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
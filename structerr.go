@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// StructuredError describes a failed propagation in a form that log aggregation
+// systems can index. It serializes to JSON and wraps the original error.
+type StructuredError struct {
+	Code      string    `json:"code"`
+	Message   string    `json:"message"`
+	UUID      string    `json:"uuid"`
+	Timestamp time.Time `json:"timestamp"`
+
+	err error
+}
+
+// NewStructuredError wraps the error returned when propagating the job with the
+// given UUID.
+func NewStructuredError(uuid string, err error) *StructuredError {
+	return &StructuredError{
+		Code:      errorCode(err),
+		Message:   err.Error(),
+		UUID:      uuid,
+		Timestamp: time.Now().UTC(),
+		err:       err,
+	}
+}
+
+// errorCode returns a short, stable code for the kind of error.
+func errorCode(err error) string {
+	var respErr *ResponseError
+	var urlErr *url.Error
+	switch {
+	case errors.As(err, &respErr):
+		return fmt.Sprintf("http_%d", respErr.StatusCode)
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &urlErr):
+		return "transport_error"
+	default:
+		return "internal_error"
+	}
+}
+
+func (e *StructuredError) Error() string {
+	return fmt.Sprintf("propagating job %s failed (%s): %s", e.UUID, e.Code, e.Message)
+}
+
+func (e *StructuredError) Unwrap() error {
+	return e.err
+}
+
+// Fields returns the error's fields for structured log entries.
+func (e *StructuredError) Fields() logrus.Fields {
+	return logrus.Fields{
+		"error_code":      e.Code,
+		"error_message":   e.Message,
+		"error_uuid":      e.UUID,
+		"error_timestamp": e.Timestamp.Format(time.RFC3339Nano),
+	}
+}
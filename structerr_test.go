@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+func TestStructuredError(t *testing.T) {
+	respErr := &ResponseError{StatusCode: 503, Status: "503 Service Unavailable", Body: "try again"}
+	err := NewStructuredError("job-1", pkgerrors.WithStack(respErr))
+
+	if err.Code != "http_503" {
+		t.Errorf("code was %s instead of http_503", err.Code)
+	}
+
+	var unwrapped *ResponseError
+	if !errors.As(err, &unwrapped) {
+		t.Error("the ResponseError can't be unwrapped from the StructuredError")
+	}
+
+	expected := "propagating job job-1 failed (http_503): apps returned 503: try again"
+	if err.Error() != expected {
+		t.Errorf("Error() returned %q instead of %q", err.Error(), expected)
+	}
+
+	b, jsonErr := json.Marshal(err)
+	if jsonErr != nil {
+		t.Fatalf("error marshaling the StructuredError: %s", jsonErr)
+	}
+	var decoded map[string]any
+	if jsonErr = json.Unmarshal(b, &decoded); jsonErr != nil {
+		t.Fatalf("error unmarshaling the StructuredError: %s", jsonErr)
+	}
+	for _, key := range []string{"code", "message", "uuid", "timestamp"} {
+		if _, ok := decoded[key]; !ok {
+			t.Errorf("the JSON is missing the %s field: %s", key, b)
+		}
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	tests := map[error]string{
+		fmt.Errorf("waiting: %w", context.DeadlineExceeded): "timeout",
+		errors.New("something else"):                        "internal_error",
+	}
+	for err, expected := range tests {
+		if actual := errorCode(err); actual != expected {
+			t.Errorf("errorCode(%q) returned %s instead of %s", err, actual, expected)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// BatchOptions configures the batch span processor that
+// otelutils.TracerProviderFromEnv exports spans with.
+type BatchOptions struct {
+	MaxExportBatchSize int
+	BatchTimeout       time.Duration
+}
+
+// SetEnv sets the OTEL_BSP_* environment variables that the batch span
+// processor reads its settings from, so it must be called before the tracer
+// provider is set up.
+func (o BatchOptions) SetEnv() error {
+	if err := os.Setenv("OTEL_BSP_MAX_EXPORT_BATCH_SIZE", strconv.Itoa(o.MaxExportBatchSize)); err != nil {
+		return err
+	}
+	return os.Setenv("OTEL_BSP_SCHEDULE_DELAY", strconv.FormatInt(o.BatchTimeout.Milliseconds(), 10))
+}
+
+// TextMapPropagator returns the propagator for the trace context format
+// selected by --tracing-propagation-format: w3c for the W3C Trace Context and
+// Baggage headers, b3 for the single b3 header, or b3multi for the X-B3-*
+// headers.
+func TextMapPropagator(format string) (propagation.TextMapPropagator, error) {
+	switch format {
+	case "w3c":
+		return propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}), nil
+	case "b3":
+		return b3.New(b3.WithInjectEncoding(b3.B3SingleHeader)), nil
+	case "b3multi":
+		return b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader)), nil
+	default:
+		return nil, fmt.Errorf("unknown trace propagation format %q; it must be w3c, b3, or b3multi", format)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBatchOptionsSetEnv(t *testing.T) {
+	// t.Setenv restores the variables after the test.
+	t.Setenv("OTEL_BSP_MAX_EXPORT_BATCH_SIZE", "")
+	t.Setenv("OTEL_BSP_SCHEDULE_DELAY", "")
+
+	opts := BatchOptions{MaxExportBatchSize: 256, BatchTimeout: 2 * time.Second}
+	if err := opts.SetEnv(); err != nil {
+		t.Fatalf("error from SetEnv(): %s", err)
+	}
+
+	if actual := os.Getenv("OTEL_BSP_MAX_EXPORT_BATCH_SIZE"); actual != "256" {
+		t.Errorf("OTEL_BSP_MAX_EXPORT_BATCH_SIZE was %q instead of 256", actual)
+	}
+	if actual := os.Getenv("OTEL_BSP_SCHEDULE_DELAY"); actual != "2000" {
+		t.Errorf("OTEL_BSP_SCHEDULE_DELAY was %q instead of 2000", actual)
+	}
+}
+
+func TestTextMapPropagator(t *testing.T) {
+	tests := map[string][]string{
+		"w3c":     {"baggage", "traceparent", "tracestate"},
+		"b3":      {"b3"},
+		"b3multi": {"x-b3-flags", "x-b3-sampled", "x-b3-spanid", "x-b3-traceid"},
+	}
+
+	for format, expected := range tests {
+		p, err := TextMapPropagator(format)
+		if err != nil {
+			t.Errorf("TextMapPropagator(%q) returned an error: %s", format, err)
+			continue
+		}
+		fields := p.Fields()
+		sort.Strings(fields)
+		if !reflect.DeepEqual(fields, expected) {
+			t.Errorf("TextMapPropagator(%q) uses the fields %v instead of %v", format, fields, expected)
+		}
+	}
+
+	if _, err := TextMapPropagator("jaeger"); err == nil {
+		t.Error("TextMapPropagator() didn't return an error for an unknown format")
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+// h2cRoundTripper sends plain HTTP requests using HTTP/2 cleartext (h2c) and
+// everything else through the wrapped transport.
+type h2cRoundTripper struct {
+	h2c  *http2.Transport
+	next http.RoundTripper
+}
+
+// RoundTrip sends plain HTTP requests that don't go through a proxy with h2c.
+// Proxied requests use the wrapped transport, since h2c can't be sent through
+// an HTTP proxy.
+func (rt *h2cRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" && !rt.proxied(req) {
+		return rt.h2c.RoundTrip(req)
+	}
+	return rt.next.RoundTrip(req)
+}
+
+// proxied returns true if the wrapped transport sends the request through a
+// proxy.
+func (rt *h2cRoundTripper) proxied(req *http.Request) bool {
+	t, ok := rt.next.(*http.Transport)
+	if !ok || t.Proxy == nil {
+		return false
+	}
+	proxyURL, err := t.Proxy(req)
+	return err != nil || proxyURL != nil
+}
+
+// CloseIdleConnections closes the idle connections of both transports.
+func (rt *h2cRoundTripper) CloseIdleConnections() {
+	rt.h2c.CloseIdleConnections()
+	if closer, ok := rt.next.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// ConfigureHTTP2 sets up HTTP/2 support for requests to the apps service and
+// returns the http.RoundTripper that should be used to send them. The mode is
+// one of "auto", "true", or "false". In auto mode, HTTP/2 is negotiated over TLS
+// only, which is the default behavior of the net/http package.
+func ConfigureHTTP2(t *http.Transport, mode string) (http.RoundTripper, error) {
+	switch mode {
+	case "auto":
+		return t, nil
+
+	case "true":
+		if err := http2.ConfigureTransport(t); err != nil {
+			return nil, err
+		}
+
+		// The h2c transport is configured from a copy of t so that it uses the
+		// same timeouts, keep-alive and compression settings, and dialer.
+		base := t.Clone()
+		h2c, err := http2.ConfigureTransports(base)
+		if err != nil {
+			return nil, err
+		}
+		// The connection pool set up for TLS upgrades never dials, so h2c
+		// uses the default pool instead.
+		h2c.ConnPool = nil
+		h2c.AllowHTTP = true
+		h2c.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			if base.DialContext != nil {
+				return base.DialContext(ctx, network, addr)
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}
+		return &h2cRoundTripper{h2c: h2c, next: t}, nil
+
+	case "false":
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		return t, nil
+
+	default:
+		return nil, fmt.Errorf("invalid HTTP/2 mode %q: must be auto, true, or false", mode)
+	}
+}
+
+// compressingRoundTripper gzips request bodies of at least minSize bytes before
+// sending them through the wrapped transport. Smaller bodies are sent as they
+// are, since compressing them isn't worth the overhead.
+type compressingRoundTripper struct {
+	minSize int
+	next    http.RoundTripper
+}
+
+// NewCompressingRoundTripper returns an http.RoundTripper that gzips request
+// bodies of at least minSize bytes and sends requests through next.
+func NewCompressingRoundTripper(next http.RoundTripper, minSize int) http.RoundTripper {
+	return &compressingRoundTripper{minSize: minSize, next: next}
+}
+
+func (rt *compressingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.Header.Get("Content-Encoding") != "" {
+		return rt.next.RoundTrip(req)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// Round trippers mustn't modify the caller's request.
+	out := req.Clone(req.Context())
+	if len(body) < rt.minSize {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+		out.ContentLength = int64(len(body))
+		return rt.next.RoundTrip(out)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err = gz.Write(body); err != nil {
+		return nil, err
+	}
+	if err = gz.Close(); err != nil {
+		return nil, err
+	}
+	compressed := buf.Bytes()
+	log.Debugf("Compressed the request body to %s from %d to %d bytes (ratio %.2f)", req.URL.Host, len(body), len(compressed), float64(len(compressed))/float64(len(body)))
+
+	out.Body = io.NopCloser(bytes.NewReader(compressed))
+	out.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(compressed)), nil
+	}
+	out.ContentLength = int64(len(compressed))
+	out.Header.Set("Content-Encoding", "gzip")
+	return rt.next.RoundTrip(out)
+}
+
+// authRoundTripper adds an authentication header to every request sent through
+// the wrapped transport.
+type authRoundTripper struct {
+	header string
+	value  string
+	next   http.RoundTripper
+}
+
+// NewAuthRoundTripper returns an http.RoundTripper that sends token in the
+// given header. The token is sent as a bearer token if the header is
+// Authorization and as it is otherwise, e.g. for X-API-Key.
+func NewAuthRoundTripper(next http.RoundTripper, header, token string) http.RoundTripper {
+	value := token
+	if http.CanonicalHeaderKey(header) == "Authorization" {
+		value = "Bearer " + token
+	}
+	return &authRoundTripper{header: header, value: value, next: next}
+}
+
+func (rt *authRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Round trippers mustn't modify the caller's request.
+	out := req.Clone(req.Context())
+	out.Header.Set(rt.header, rt.value)
+	return rt.next.RoundTrip(out)
+}
+
+// headerLogRoundTripper logs the headers of each request sent through the
+// wrapped transport and of its response at the debug level.
+type headerLogRoundTripper struct {
+	redact map[string]bool
+	next   http.RoundTripper
+}
+
+// NewHeaderLogRoundTripper returns an http.RoundTripper that logs request and
+// response headers at the debug level. The values of the Authorization, cookie,
+// and redact headers are replaced with ***.
+func NewHeaderLogRoundTripper(next http.RoundTripper, redact ...string) http.RoundTripper {
+	rt := &headerLogRoundTripper{
+		redact: map[string]bool{
+			"Authorization":       true,
+			"Proxy-Authorization": true,
+			"Cookie":              true,
+			"Set-Cookie":          true,
+		},
+		next: next,
+	}
+	for _, name := range redact {
+		rt.redact[http.CanonicalHeaderKey(name)] = true
+	}
+	return rt
+}
+
+// headers returns the headers with the sensitive values redacted.
+func (rt *headerLogRoundTripper) headers(h http.Header) http.Header {
+	out := h.Clone()
+	for name := range out {
+		if rt.redact[name] {
+			out[name] = []string{"***"}
+		}
+	}
+	return out
+}
+
+func (rt *headerLogRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	entry := loggerFromContext(req.Context())
+	entry.WithField("headers", rt.headers(req.Header)).Debugf("Request: %s %s", req.Method, MaskAppsURI(req.URL.String()))
+
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	entry.WithField("headers", rt.headers(resp.Header)).Debugf("Response: %s", resp.Status)
+	return resp, nil
+}
+
+// RebuildingRoundTripper is an http.RoundTripper whose underlying transport can
+// be replaced with a freshly built one, so that new requests open new
+// connections.
+type RebuildingRoundTripper struct {
+	build func() (http.RoundTripper, error)
+
+	mu        sync.RWMutex
+	transport http.RoundTripper
+}
+
+// NewRebuildingRoundTripper returns a *RebuildingRoundTripper that gets its
+// transports from build.
+func NewRebuildingRoundTripper(build func() (http.RoundTripper, error)) (*RebuildingRoundTripper, error) {
+	transport, err := build()
+	if err != nil {
+		return nil, err
+	}
+	return &RebuildingRoundTripper{build: build, transport: transport}, nil
+}
+
+// RoundTrip sends the request using the current transport.
+func (r *RebuildingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.RLock()
+	transport := r.transport
+	r.mu.RUnlock()
+	return transport.RoundTrip(req)
+}
+
+// Rebuild replaces the current transport with a new one and closes the old
+// one's idle connections. The current transport is kept if a new one can't be
+// built.
+func (r *RebuildingRoundTripper) Rebuild() error {
+	transport, err := r.build()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	old := r.transport
+	r.transport = transport
+	r.mu.Unlock()
+
+	if closer, ok := old.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestConfigureHTTP2Cleartext(t *testing.T) {
+	var proto int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto = r.ProtoMajor
+	})
+	server := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer server.Close()
+
+	rt, err := ConfigureHTTP2(http.DefaultTransport.(*http.Transport).Clone(), "true")
+	if err != nil {
+		t.Fatalf("error calling ConfigureHTTP2(): %s", err)
+	}
+
+	client := http.Client{Transport: rt}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("error sending request: %s", err)
+	}
+	resp.Body.Close()
+
+	if proto != 2 {
+		t.Errorf("request used HTTP/%d instead of HTTP/2", proto)
+	}
+
+	if _, err = ConfigureHTTP2(http.DefaultTransport.(*http.Transport).Clone(), "sometimes"); err == nil {
+		t.Error("expected an error for an invalid mode")
+	}
+}
+
+func TestConfigureHTTP2CleartextTimeout(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	server := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer server.Close()
+
+	// The h2c transport uses the settings of the transport it's given.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 20 * time.Millisecond
+	rt, err := ConfigureHTTP2(transport, "true")
+	if err != nil {
+		t.Fatalf("error calling ConfigureHTTP2(): %s", err)
+	}
+
+	client := http.Client{Transport: rt}
+	resp, err := client.Get(server.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("expected the response header timeout to expire")
+	}
+	if !strings.Contains(err.Error(), "timeout awaiting response headers") {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestCompressingRoundTripper(t *testing.T) {
+	var encoding, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		var reader io.Reader = r.Body
+		if encoding == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Fatalf("error reading the gzipped body: %s", err)
+			}
+			reader = gz
+		}
+		b, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("error reading the body: %s", err)
+		}
+		body = string(b)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewCompressingRoundTripper(http.DefaultTransport, 512)}
+
+	tests := []struct {
+		body     string
+		encoding string
+	}{
+		{`{"uuid":"external-id"}`, ""},
+		{strings.Repeat(`{"uuid":"external-id"}`, 50), "gzip"},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("error creating the request: %s", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("error sending the request: %s", err)
+		}
+		resp.Body.Close()
+
+		if encoding != test.encoding {
+			t.Errorf("a %d-byte body was sent with Content-Encoding %q instead of %q", len(test.body), encoding, test.encoding)
+		}
+		if body != test.body {
+			t.Errorf("the server received %q instead of %q", body, test.body)
+		}
+		if req.Header.Get("Content-Encoding") != "" {
+			t.Error("the caller's request was modified")
+		}
+	}
+}
+
+func TestAuthRoundTripper(t *testing.T) {
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		header, name, expected string
+	}{
+		{"Authorization", "Authorization", "Bearer s3cret"},
+		{"X-API-Key", "X-Api-Key", "s3cret"},
+	}
+
+	for _, test := range tests {
+		client := &http.Client{Transport: NewAuthRoundTripper(http.DefaultTransport, test.header, "s3cret")}
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatalf("error creating the request: %s", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("error sending the request: %s", err)
+		}
+		resp.Body.Close()
+
+		if actual := headers.Get(test.name); actual != test.expected {
+			t.Errorf("the %s header was %q instead of %q", test.name, actual, test.expected)
+		}
+		if req.Header.Get(test.header) != "" {
+			t.Error("the caller's request was modified")
+		}
+	}
+}
+
+type closingRoundTripper struct {
+	name   string
+	closed bool
+}
+
+func (c *closingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Status: c.name, Body: http.NoBody}, nil
+}
+
+func (c *closingRoundTripper) CloseIdleConnections() {
+	c.closed = true
+}
+
+func TestRebuildingRoundTripper(t *testing.T) {
+	var built []*closingRoundTripper
+	r, err := NewRebuildingRoundTripper(func() (http.RoundTripper, error) {
+		rt := &closingRoundTripper{name: fmt.Sprintf("transport %d", len(built)+1)}
+		built = append(built, rt)
+		return rt, nil
+	})
+	if err != nil {
+		t.Fatalf("NewRebuildingRoundTripper returned an error: %s", err)
+	}
+
+	if err = r.Rebuild(); err != nil {
+		t.Fatalf("Rebuild returned an error: %s", err)
+	}
+	if !built[0].closed {
+		t.Error("the old transport's idle connections weren't closed")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://apps/callbacks", nil)
+	resp, err := r.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip returned an error: %s", err)
+	}
+	if resp.Status != "transport 2" {
+		t.Errorf("the request was sent with %s instead of transport 2", resp.Status)
+	}
+}
+
+func TestHeaderLogRoundTripper(t *testing.T) {
+	hook := logtest.NewLocal(log.Logger)
+	defer log.Logger.ReplaceHooks(make(logrus.LevelHooks))
+	level := log.Logger.GetLevel()
+	log.Logger.SetLevel(logrus.DebugLevel)
+	defer log.Logger.SetLevel(level)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-ID", "request-1")
+	}))
+	defer server.Close()
+
+	rt := NewHeaderLogRoundTripper(http.DefaultTransport, "X-API-Key")
+	client := &http.Client{Transport: NewAuthRoundTripper(rt, "X-API-Key", "s3cret")}
+	req, err := http.NewRequest(http.MethodPost, server.URL, nil)
+	if err != nil {
+		t.Fatalf("error creating the request: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer other")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("error sending the request: %s", err)
+	}
+	resp.Body.Close()
+
+	entries := hook.AllEntries()
+	if len(entries) != 2 {
+		t.Fatalf("%d entries were logged instead of 2", len(entries))
+	}
+
+	reqHeaders := entries[0].Data["headers"].(http.Header)
+	for name, expected := range map[string]string{"X-Api-Key": "***", "Authorization": "***", "Content-Type": "application/json"} {
+		if actual := reqHeaders.Get(name); actual != expected {
+			t.Errorf("the logged %s header was %q instead of %q", name, actual, expected)
+		}
+	}
+	if actual := entries[1].Data["headers"].(http.Header).Get("X-Request-ID"); actual != "request-1" {
+		t.Errorf("the logged X-Request-ID header was %q instead of request-1", actual)
+	}
+}
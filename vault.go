@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/spf13/viper"
+)
+
+// NewVaultClient returns a Vault client for the server at addr that
+// authenticates with token. Empty values fall back to the VAULT_ADDR and
+// VAULT_TOKEN environment variables.
+func NewVaultClient(addr, token string) (*vaultapi.Client, error) {
+	vaultCfg := vaultapi.DefaultConfig()
+	if vaultCfg.Error != nil {
+		return nil, vaultCfg.Error
+	}
+	if addr != "" {
+		vaultCfg.Address = addr
+	}
+
+	client, err := vaultapi.NewClient(vaultCfg)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		client.SetToken(token)
+	}
+	return client, nil
+}
+
+// MergeVaultSecret reads the secret at path and merges it into cfg. The secret
+// must have the same keys as the config file; values in the secret take
+// precedence over the ones in the file. Secrets in a KV version 2 engine are
+// read from their data field.
+func MergeVaultSecret(ctx context.Context, client *vaultapi.Client, path string, cfg *viper.Viper) error {
+	secret, err := client.Logical().ReadWithContext(ctx, path)
+	if err != nil {
+		return err
+	}
+	if secret == nil || secret.Data == nil {
+		return fmt.Errorf("no Vault secret found at %s", path)
+	}
+
+	values := secret.Data
+	if data, ok := secret.Data["data"].(map[string]any); ok {
+		if _, ok = secret.Data["metadata"]; ok {
+			values = data
+		}
+	}
+	return cfg.MergeConfigMap(values)
+}
+
+// RenewVaultToken keeps the client's token alive by renewing it halfway
+// through each lease until the context is cancelled. If the token can't be
+// renewed, it logs a warning when the token expires and the service keeps
+// using the config values it already read.
+func RenewVaultToken(ctx context.Context, client *vaultapi.Client) {
+	secret, err := client.Auth().Token().LookupSelfWithContext(ctx)
+	if err != nil {
+		log.Warnf("Unable to look up the Vault token, so it won't be renewed: %s", err)
+		return
+	}
+
+	ttl, err := secret.TokenTTL()
+	if err != nil {
+		log.Warnf("Unable to get the Vault token's TTL, so it won't be renewed: %s", err)
+		return
+	}
+	if ttl == 0 {
+		log.Info("The Vault token doesn't expire")
+		return
+	}
+	expires := time.Now().Add(ttl)
+
+	renewable, err := secret.TokenIsRenewable()
+	if err != nil || !renewable {
+		log.Warnf("The Vault token can't be renewed and expires at %s", expires.Format(time.RFC3339))
+		waitForExpiry(ctx, expires)
+		return
+	}
+
+	for {
+		if !sleepCtx(ctx, ttl/2) {
+			return
+		}
+
+		renewed, err := client.Auth().Token().RenewSelfWithContext(ctx, 0)
+		if err == nil && (renewed == nil || renewed.Auth == nil) {
+			err = fmt.Errorf("the renewal response had no auth information")
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Warnf("Unable to renew the Vault token, which expires at %s: %s", expires.Format(time.RFC3339), err)
+			waitForExpiry(ctx, expires)
+			return
+		}
+
+		ttl = time.Duration(renewed.Auth.LeaseDuration) * time.Second
+		expires = time.Now().Add(ttl)
+		log.Debugf("Renewed the Vault token until %s", expires.Format(time.RFC3339))
+	}
+}
+
+// waitForExpiry logs a warning once the Vault token expires, unless the context
+// is cancelled first.
+func waitForExpiry(ctx context.Context, expires time.Time) {
+	if sleepCtx(ctx, time.Until(expires)) {
+		log.Warn("The Vault token expired; continuing with the config values that were already read")
+	}
+}
+
+// sleepCtx waits for d to pass and returns true, or returns false if the
+// context is cancelled first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/viper"
+)
+
+func newVaultServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMergeVaultSecret(t *testing.T) {
+	tests := []struct {
+		path, body string
+	}{
+		{"/v1/secret/job-status", `{"data": {"db": {"uri": "postgres://vault/de"}}}`},
+		{"/v1/secret/data/job-status", `{"data": {"data": {"db": {"uri": "postgres://vault/de"}}, "metadata": {"version": 2}}}`},
+	}
+
+	for _, test := range tests {
+		server := newVaultServer(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Vault-Token") != "s3cret" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if r.URL.Path != test.path {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(test.body))
+		})
+
+		client, err := NewVaultClient(server.URL, "s3cret")
+		if err != nil {
+			t.Fatalf("error creating the Vault client: %s", err)
+		}
+
+		cfg := viper.New()
+		cfg.Set("apps.callbacks_uri", "http://apps/callbacks")
+		if err = MergeVaultSecret(context.Background(), client, strings.TrimPrefix(test.path, "/v1/"), cfg); err != nil {
+			t.Fatalf("MergeVaultSecret returned an error: %s", err)
+		}
+
+		if actual := cfg.GetString("db.uri"); actual != "postgres://vault/de" {
+			t.Errorf("db.uri was %q instead of postgres://vault/de", actual)
+		}
+		if actual := cfg.GetString("apps.callbacks_uri"); actual != "http://apps/callbacks" {
+			t.Errorf("apps.callbacks_uri was %q instead of http://apps/callbacks", actual)
+		}
+	}
+}
+
+func TestMergeVaultSecretMissing(t *testing.T) {
+	server := newVaultServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	client, err := NewVaultClient(server.URL, "s3cret")
+	if err != nil {
+		t.Fatalf("error creating the Vault client: %s", err)
+	}
+	if err = MergeVaultSecret(context.Background(), client, "secret/missing", viper.New()); err == nil {
+		t.Error("MergeVaultSecret didn't return an error for a missing secret")
+	}
+}
+
+func TestRenewVaultToken(t *testing.T) {
+	hook := logtest.NewLocal(log.Logger)
+	defer log.Logger.ReplaceHooks(make(logrus.LevelHooks))
+
+	var renewals atomic.Int64
+	server := newVaultServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/auth/token/lookup-self":
+			w.Write([]byte(`{"data": {"ttl": 1, "renewable": true}}`))
+		case "/v1/auth/token/renew-self":
+			if renewals.Add(1) > 1 {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"errors": ["permission denied"]}`))
+				return
+			}
+			w.Write([]byte(`{"auth": {"client_token": "s3cret", "lease_duration": 1, "renewable": true}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	client, err := NewVaultClient(server.URL, "s3cret")
+	if err != nil {
+		t.Fatalf("error creating the Vault client: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	RenewVaultToken(ctx, client)
+
+	if actual := renewals.Load(); actual != 2 {
+		t.Errorf("the token was renewed %d times instead of 2", actual)
+	}
+
+	var expired bool
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.WarnLevel && strings.Contains(entry.Message, "expired") {
+			expired = true
+		}
+	}
+	if !expired {
+		t.Error("no warning was logged when the token expired")
+	}
+}
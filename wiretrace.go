@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WireLogger records the DNS lookup, TCP connect, TLS handshake, and server
+// processing times of requests to the apps service as span events and debug
+// log entries. At most maxEntries requests are logged between calls to Reset.
+type WireLogger struct {
+	maxEntries int64
+	entries    atomic.Int64
+}
+
+// NewWireLogger returns a WireLogger that logs up to maxEntries requests per
+// propagation pass.
+func NewWireLogger(maxEntries int64) *WireLogger {
+	return &WireLogger{maxEntries: maxEntries}
+}
+
+// Reset starts a new propagation pass, allowing another maxEntries requests to
+// be logged.
+func (w *WireLogger) Reset() {
+	w.entries.Store(0)
+}
+
+// Trace returns a copy of the context that logs the timings of the request it's
+// used for, unless the limit for the current pass has already been reached.
+func (w *WireLogger) Trace(ctx context.Context) context.Context {
+	if w.entries.Add(1) > w.maxEntries {
+		return ctx
+	}
+
+	var (
+		mu                                          sync.Mutex
+		dnsStart, connectStart, tlsStart, wroteTime time.Time
+		timings                                     = make(logrus.Fields)
+	)
+
+	span := trace.SpanFromContext(ctx)
+	start := func(t *time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+		*t = time.Now()
+	}
+	record := func(name string, start *time.Time) {
+		mu.Lock()
+		d := time.Since(*start)
+		timings[name] = d.String()
+		mu.Unlock()
+		span.AddEvent(name, trace.WithAttributes(attribute.Int64("duration_ms", d.Milliseconds())))
+	}
+
+	clientTrace := &httptrace.ClientTrace{
+		DNSStart:     func(httptrace.DNSStartInfo) { start(&dnsStart) },
+		DNSDone:      func(httptrace.DNSDoneInfo) { record("dns_lookup", &dnsStart) },
+		ConnectStart: func(string, string) { start(&connectStart) },
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				record("tcp_connect", &connectStart)
+			}
+		},
+		TLSHandshakeStart: func() { start(&tlsStart) },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				record("tls_handshake", &tlsStart)
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) { start(&wroteTime) },
+		GotFirstResponseByte: func() {
+			record("server_processing", &wroteTime)
+			mu.Lock()
+			defer mu.Unlock()
+			loggerFromContext(ctx).WithFields(timings).Debug("Apps service request timings")
+		},
+	}
+
+	return httptrace.WithClientTrace(ctx, clientTrace)
+}
+
+// ConnectionReuseTracker counts how many of the connections used for requests
+// to the apps service in a propagation pass were reused from the pool and how
+// many were newly established.
+type ConnectionReuseTracker struct {
+	reused atomic.Int64
+	opened atomic.Int64
+}
+
+// Reset starts a new propagation pass.
+func (c *ConnectionReuseTracker) Reset() {
+	c.reused.Store(0)
+	c.opened.Store(0)
+}
+
+// Trace returns a copy of the context that records whether the connection used
+// by the request it's used for was reused.
+func (c *ConnectionReuseTracker) Trace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				c.reused.Add(1)
+			} else {
+				c.opened.Add(1)
+			}
+		},
+	})
+}
+
+// Ratio returns the fraction of connections that were reused in the current
+// pass along with the total number of connections used.
+func (c *ConnectionReuseTracker) Ratio() (float64, int64) {
+	reused, opened := c.reused.Load(), c.opened.Load()
+	total := reused + opened
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(reused) / float64(total), total
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+)
+
+func TestWireLoggerTrace(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	w := NewWireLogger(1)
+
+	ctx := w.Trace(context.Background())
+	if httptrace.ContextClientTrace(ctx) == nil {
+		t.Fatal("expected a client trace for the first request")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if httptrace.ContextClientTrace(w.Trace(context.Background())) != nil {
+		t.Error("expected no client trace once the limit was reached")
+	}
+
+	w.Reset()
+	if httptrace.ContextClientTrace(w.Trace(context.Background())) == nil {
+		t.Error("expected a client trace after Reset()")
+	}
+}
+
+func TestConnectionReuseTracker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	c := &ConnectionReuseTracker{}
+	client := server.Client()
+
+	for i := 0; i < 4; i++ {
+		req, err := http.NewRequestWithContext(c.Trace(context.Background()), http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	ratio, total := c.Ratio()
+	if total != 4 {
+		t.Errorf("total was %d instead of 4", total)
+	}
+	if ratio != 0.75 {
+		t.Errorf("reuse ratio was %f instead of 0.75", ratio)
+	}
+
+	c.Reset()
+	if _, total = c.Ratio(); total != 0 {
+		t.Errorf("total was %d instead of 0 after Reset()", total)
+	}
+}